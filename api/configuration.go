@@ -1,5 +1,7 @@
 package api
 
+import "net"
+
 // Configuration is the configuration structure used by the program.
 type Configuration struct {
 	Storage                 storageConfig
@@ -8,12 +10,22 @@ type Configuration struct {
 	Security                securityConfig
 	Server                  serverConfig
 	Redis                   redisConfig
+	Store                   storeConfig
 	MoreStats               bool
 	ForceZeroWidth          bool
 	StatsCollectionInterval int
 	Logging                 loggingConfig
 	Encryption              encryptionConfig
 	Domain                  string
+	WatchConfig             bool
+
+	// PathLengthLimitBytes is the longest request URI ServeFile accepts. It's derived from other values
+	// when the configuration is loaded.
+	PathLengthLimitBytes int `mapstructure:"-"`
+	// TrustedProxyNets are the parsed Security.TrustedProxies.
+	TrustedProxyNets []*net.IPNet `mapstructure:"-"`
+	// RateLimitExemptNets are the parsed RateLimit.Exempt.CIDRs.
+	RateLimitExemptNets []*net.IPNet `mapstructure:"-"`
 }
 
 type encryptionConfig struct {
@@ -22,8 +34,27 @@ type encryptionConfig struct {
 }
 
 type loggingConfig struct {
-	Enabled bool
-	LogFile string
+	Enabled   bool
+	LogFile   string
+	Level     string
+	Format    string
+	AccessLog accessLogConfig
+	Rotation  logRotationConfig
+}
+
+type logRotationConfig struct {
+	MaxSize    int
+	MaxAge     int
+	MaxBackups int
+	Compress   bool
+}
+
+type accessLogConfig struct {
+	Enabled            bool
+	File               string
+	Format             string
+	AnonymizeIP        bool
+	StripEncryptionKey bool
 }
 
 type storageConfig struct {
@@ -31,17 +62,48 @@ type storageConfig struct {
 	MaxSize                int
 	IDLength               int
 	CollisionCheckAttempts int
+	Layout                 string
+	ShardLength            int
+	MinFreeSpace           int
+	MinFreePercent         float64
+	MaxTotalSize           int
+	EvictOldest            bool
 }
 
 type rateLimitConfig struct {
 	ResetAfter int
+	Algorithm  string
+	Backend    string
+	Fallback   string
+	IPv4Prefix int
+	IPv6Prefix int
 	Path       struct {
-		Upload int
-		Global int
+		Upload              int
+		Global              int
+		GlobalAuthenticated int
 	}
+	Policies  []RateLimitPolicy
+	Exempt    rateLimitExemptConfig
 	Bandwidth rateLimitBandwidthConfig
 }
 
+// RateLimitPolicy limits the requests made to the routes matching Route.
+type RateLimitPolicy struct {
+	// Route is a pattern as used by path.Match, like /upload or /*.png.
+	Route string
+	// Limit is how many requests anonymous clients can make per ResetAfter.
+	Limit int
+	// AuthenticatedLimit is how many requests clients using the master key can make per ResetAfter.
+	AuthenticatedLimit int
+	// ResetAfter overrides RateLimit.ResetAfter for this policy.
+	ResetAfter int
+}
+
+type rateLimitExemptConfig struct {
+	Keys  []string
+	CIDRs []string
+}
+
 type rateLimitBandwidthConfig struct {
 	ResetAfter int
 	Download   int
@@ -57,17 +119,70 @@ type filterConfig struct {
 type securityConfig struct {
 	MasterKey                    string
 	DisableEmptyMasterKeyWarning bool
+	TrustedProxies               []string
+	ClientIPHeaders              []string
+	TrustUnixSocket              bool
 }
 
 type serverConfig struct {
-	Port         int
-	Concurrency  int
-	ReadTimeout  int
-	WriteTimeout int
+	Port            int
+	Concurrency     int
+	ReadTimeout     int
+	WriteTimeout    int
+	TLS             serverTLSConfig
+	Listen          []string
+	UnixSocket      serverUnixSocketConfig
+	SystemdSocket   bool
+	ShutdownTimeout int
+}
+
+type serverUnixSocketConfig struct {
+	Path        string
+	Permissions string
+}
+
+type serverTLSConfig struct {
+	Enabled          bool
+	CertFile         string
+	KeyFile          string
+	MinVersion       string
+	CipherSuites     []string
+	ReloadInterval   int
+	RedirectHTTPPort int
+	RedirectHost     string
 }
 
 type redisConfig struct {
-	URI      string
-	Password string
-	DB       int
+	URI              string
+	KeyPrefix        string
+	Addresses        []string
+	Username         string
+	Password         string
+	DB               int
+	Cluster          bool
+	MasterName       string
+	SentinelUsername string
+	SentinelPassword string
+	TLS              redisTLSConfig
+	PoolSize         int
+	MinIdleConns     int
+	MaxRetries       int
+	DialTimeout      int
+	ReadTimeout      int
+	WriteTimeout     int
+	PoolTimeout      int
+}
+
+type redisTLSConfig struct {
+	Enabled            bool
+	CAFile             string
+	CertFile           string
+	KeyFile            string
+	ServerName         string
+	InsecureSkipVerify bool
+}
+
+type storeConfig struct {
+	Type string
+	Path string
 }
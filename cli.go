@@ -0,0 +1,317 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"github.com/spf13/viper"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+	"tytanium/api"
+	"tytanium/constants"
+	"tytanium/global"
+	"tytanium/utils"
+)
+
+// command is a subcommand of the tytanium binary.
+type command struct {
+	name        string
+	description string
+	run         func(args []string) int
+}
+
+var commands []command
+
+func init() {
+	commands = []command{
+		{"serve", "Start the server (default if no command is given)", serveCommand},
+		{"check-config", "Validate the configuration and exit", checkConfigCommand},
+		{"keygen", "Generate a random master key", keygenCommand},
+		{"gc", "Delete stored files older than a given age", gcCommand},
+		{"migrate", "Move the stored files to another storage layout", migrateCommand},
+		{"healthcheck", "Check that the running server is ready, for a Docker HEALTHCHECK", healthcheckCommand},
+		{"stats", "Count the stored files and their total size, optionally saving the result for /stats", statsCommand},
+		{"version", "Print the version and exit", versionCommand},
+		{"help", "Show this help", helpCommand},
+	}
+}
+
+// run executes the command given in args and returns the exit code.
+// Running tytanium without a command, or with only flags, starts the server.
+func run(args []string) int {
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		return serveCommand(args)
+	}
+	for _, c := range commands {
+		if c.name == args[0] {
+			return c.run(args[1:])
+		}
+	}
+	fmt.Fprintf(os.Stderr, "Unknown command %q\n\n", args[0])
+	printUsage()
+	return 2
+}
+
+func printUsage() {
+	fmt.Fprintln(os.Stderr, "Usage: tytanium <command> [flags]")
+	fmt.Fprintln(os.Stderr, "\nCommands:")
+	for _, c := range commands {
+		fmt.Fprintf(os.Stderr, "  %-14s %s\n", c.name, c.description)
+	}
+	fmt.Fprintln(os.Stderr, "\nRun tytanium <command> -h to see the flags of a command.")
+}
+
+// stringList is a flag that can be given more than once.
+type stringList []string
+
+func (s *stringList) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stringList) Set(v string) error {
+	*s = append(*s, v)
+	return nil
+}
+
+// configFlags are the flags shared by every command that reads the configuration.
+// Values given with them take precedence over the configuration file and the environment.
+type configFlags struct {
+	file       string
+	set        stringList
+	domain     string
+	port       int
+	storageDir string
+	redisURI   string
+	logFile    string
+	logLevel   string
+}
+
+func addConfigFlags(fs *flag.FlagSet) *configFlags {
+	f := &configFlags{}
+	fs.StringVar(&f.file, "config", "", "path to the configuration file (default ./conf/config.yml)")
+	fs.Var(&f.set, "set", "override any configuration value, like -set RateLimit.Path.Upload=20 (can be repeated)")
+	fs.StringVar(&f.domain, "domain", "", "override Domain")
+	fs.IntVar(&f.port, "port", 0, "override Server.Port")
+	fs.StringVar(&f.storageDir, "storage-dir", "", "override Storage.Directory")
+	fs.StringVar(&f.redisURI, "redis-uri", "", "override Redis.URI")
+	fs.StringVar(&f.logFile, "log-file", "", "override Logging.LogFile")
+	fs.StringVar(&f.logLevel, "log-level", "", "override Logging.Level")
+	return f
+}
+
+// apply sets up viper with the configuration file and the overrides given on the command line.
+func (f *configFlags) apply(fs *flag.FlagSet) error {
+	if err := setupConfiguration(f.file); err != nil {
+		return err
+	}
+
+	overrides := map[string]string{
+		"domain":      "Domain",
+		"port":        "Server.Port",
+		"storage-dir": "Storage.Directory",
+		"redis-uri":   "Redis.URI",
+		"log-file":    "Logging.LogFile",
+		"log-level":   "Logging.Level",
+	}
+	var err error
+	fs.Visit(func(fl *flag.Flag) {
+		if key, ok := overrides[fl.Name]; ok {
+			viper.Set(key, fl.Value.String())
+		}
+	})
+	for _, s := range f.set {
+		kv := strings.SplitN(s, "=", 2)
+		if len(kv) != 2 || len(kv[0]) == 0 {
+			err = fmt.Errorf("-set %q must be in the form Key=Value", s)
+			break
+		}
+		viper.Set(kv[0], kv[1])
+	}
+	return err
+}
+
+// loadCommandConfiguration parses the flags of a command that needs the configuration, then loads and publishes it.
+// If that fails, the configuration is nil and the command should exit with the returned code.
+func loadCommandConfiguration(fs *flag.FlagSet, args []string) (*api.Configuration, int) {
+	f := addConfigFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return nil, 2
+	}
+	if err := f.apply(fs); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return nil, 2
+	}
+	c, err := loadConfiguration()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return nil, 1
+	}
+	global.SetConfig(c)
+	return c, 0
+}
+
+func serveCommand(args []string) int {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	f := addConfigFlags(fs)
+	_ = fs.Parse(args)
+	if err := f.apply(fs); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	initServer()
+	return serve()
+}
+
+// checkConfigCommand validates a configuration file without starting the server.
+// The file to check may also be given as the only argument instead of with -config.
+func checkConfigCommand(args []string) int {
+	fs := flag.NewFlagSet("check-config", flag.ExitOnError)
+	f := addConfigFlags(fs)
+	_ = fs.Parse(args)
+	if fs.NArg() > 1 {
+		fmt.Fprintln(os.Stderr, "Usage: tytanium check-config [flags] [path to config file]")
+		return 2
+	}
+	if fs.NArg() == 1 {
+		f.file = fs.Arg(0)
+	}
+	if err := f.apply(fs); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	if _, err := loadConfiguration(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	source := viper.ConfigFileUsed()
+	if len(source) == 0 {
+		source = "The configuration (from environment variables only)"
+	}
+	fmt.Printf("%s is valid.\n", source)
+	return 0
+}
+
+func keygenCommand(args []string) int {
+	fs := flag.NewFlagSet("keygen", flag.ExitOnError)
+	length := fs.Int("length", 32, "number of random bytes in the key (the key is hex encoded, so it's twice as long)")
+	_ = fs.Parse(args)
+	if *length < 1 {
+		fmt.Fprintln(os.Stderr, "-length must be at least 1")
+		return 2
+	}
+
+	k, err := utils.RandomHex(*length)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to generate a key, %v\n", err)
+		return 1
+	}
+	fmt.Println(k)
+	return 0
+}
+
+// gcCommand deletes every file in Storage.Directory that wasn't modified within -older-than.
+func gcCommand(args []string) int {
+	fs := flag.NewFlagSet("gc", flag.ExitOnError)
+	olderThan := fs.Duration("older-than", 0, "delete files last modified longer ago than this, like 720h (required)")
+	dryRun := fs.Bool("dry-run", false, "only print what would be deleted")
+	c, code := loadCommandConfiguration(fs, args)
+	if c == nil {
+		return code
+	}
+	if *olderThan <= 0 {
+		fmt.Fprintln(os.Stderr, "-older-than must be given and greater than 0")
+		return 2
+	}
+
+	cutoff := time.Now().Add(-*olderThan)
+	var deleted, freed int64
+	err := filepath.Walk(c.Storage.Directory, func(p string, i os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		// temp files are handled below, as they can belong to uploads in progress
+		if i.IsDir() || strings.HasPrefix(i.Name(), constants.TempFilePrefix) || !i.ModTime().Before(cutoff) {
+			return nil
+		}
+		if *dryRun {
+			fmt.Println("Would delete " + p)
+		} else if err := os.Remove(p); err != nil {
+			return err
+		}
+		deleted++
+		freed += i.Size()
+		return nil
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to clean up %s, %v\n", c.Storage.Directory, err)
+		return 1
+	}
+
+	tempFiles, err := removeOrphanedTempFiles(c.Storage.Directory, *dryRun)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to remove temp files from %s, %v\n", c.Storage.Directory, err)
+		return 1
+	}
+
+	verb := "Deleted"
+	if *dryRun {
+		verb = "Would delete"
+	}
+	fmt.Printf("%s %d file(s), %d bytes, and %d temp file(s) left behind by unfinished uploads.\n", verb, deleted, freed, tempFiles)
+	return 0
+}
+
+// statsCommand does the same job as https://github.com/vysiondev/size-checker: it counts the files in Storage.Directory
+// and their total size, and with -save, writes the result to the store for /stats to return.
+func statsCommand(args []string) int {
+	fs := flag.NewFlagSet("stats", flag.ExitOnError)
+	save := fs.Bool("save", false, "save the result to the store so it's returned by /stats")
+	c, code := loadCommandConfiguration(fs, args)
+	if c == nil {
+		return code
+	}
+
+	start := time.Now()
+	totalSize, fileCount, err := countStoredFiles(c.Storage.Directory)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to read %s, %v\n", c.Storage.Directory, err)
+		return 1
+	}
+	took := time.Since(start)
+	fmt.Printf("Files: %d\nTotal size: %d bytes\nTook: %s\n", fileCount, totalSize, took)
+
+	if !*save {
+		return 0
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	s, err := openStore(c, nil)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to open the store, %v\n", err)
+		return 1
+	}
+	defer func() {
+		_ = s.Close()
+	}()
+	if err := saveStats(ctx, s, totalSize, fileCount, took); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to save stats to the store, %v\n", err)
+		return 1
+	}
+	fmt.Println("Saved to the store.")
+	return 0
+}
+
+func versionCommand(args []string) int {
+	fmt.Printf("Tytanium v%s (%s, %s/%s)\n", constants.Version, runtime.Version(), runtime.GOOS, runtime.GOARCH)
+	return 0
+}
+
+func helpCommand(args []string) int {
+	printUsage()
+	return 0
+}
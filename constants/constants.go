@@ -1,5 +1,7 @@
 package constants
 
+import "time"
+
 const (
 	// Version is the current version of the server.
 	Version = "1.4.0"
@@ -9,26 +11,54 @@ const (
 	ExtensionLengthLimit = 12
 )
 
-// PathType is an integer representation of what path is currently being handled.
-// Used mainly by constants.LimitPath.
-type PathType int
+const (
+	RateLimitBandwidthDownload = "bw_dn_"
+	RateLimitBandwidthUpload   = "bw_up_"
+)
+
+const (
+	RequestMaxBodySizePadding = 2048
+)
 
 const (
-	// LimitUploadPath represents /upload.
-	LimitUploadPath PathType = iota
+	// StatsTrafficMinuteBucket prefixes the 5 minute traffic buckets used for the rolling hourly stats.
+	StatsTrafficMinuteBucket = "st_5m_"
+	// StatsTrafficHourBucket prefixes the hourly traffic buckets used for the rolling daily stats.
+	StatsTrafficHourBucket = "st_1h_"
+)
 
-	// LimitGeneralPath represents all paths which aren't handled individually (like LimitUploadPath).
-	LimitGeneralPath
+const (
+	// RequestIDHeader is the response header containing the ID given to each request.
+	RequestIDHeader = "X-Request-ID"
+	// UserValueRequestID is the fasthttp.RequestCtx user value key holding the request ID.
+	UserValueRequestID = "request_id"
 )
 
 const (
-	RateLimitBandwidthDownload = "bw_dn_"
-	RateLimitBandwidthUpload   = "bw_up_"
+	// RateLimitLimitHeader is the response header containing the limit the request counted towards.
+	RateLimitLimitHeader = "RateLimit-Limit"
+	// RateLimitRemainingHeader is the response header containing what's left of the limit.
+	RateLimitRemainingHeader = "RateLimit-Remaining"
+	// RateLimitResetHeader is the response header containing the seconds until the limit is fully available again.
+	RateLimitResetHeader = "RateLimit-Reset"
+	// RetryAfterHeader is the response header containing the seconds to wait before trying again, when rate limited.
+	RetryAfterHeader = "Retry-After"
 )
 
 const (
-	RequestMaxBodySizePadding = 2048
+	// HealthPath only checks that the server is running.
+	HealthPath = "/healthz"
+	// ReadyPath checks that the server can handle requests.
+	ReadyPath = "/readyz"
 )
 
-// sus imposter
-var PathLengthLimitBytes int
+const (
+	// TempFilePrefix starts the names of files that are still being written to the storage directory.
+	TempFilePrefix = ".tmp-"
+	// TempFileMaxAge is how old a temp file must be before it's considered left behind by a crash and removed.
+	// Younger ones may belong to another instance using the same storage directory.
+	TempFileMaxAge = time.Hour
+	// TempFileSweepInterval is how often the running server removes temp files older than TempFileMaxAge, so the
+	// ones left behind by a crash right before a restart don't stay until the next one.
+	TempFileSweepInterval = 10 * time.Minute
+)
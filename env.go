@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"github.com/mitchellh/mapstructure"
+	"github.com/spf13/viper"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"tytanium/api"
+)
+
+const (
+	// envPrefix is put in front of every environment variable, like TYTANIUM_STORAGE_MAXSIZE for Storage.MaxSize.
+	envPrefix = "TYTANIUM"
+	// envFileSuffix is added to an environment variable's name to read its value from a file instead,
+	// like TYTANIUM_SECURITY_MASTERKEY_FILE=/run/secrets/master_key.
+	envFileSuffix = "_FILE"
+)
+
+// setupEnvironment makes every configuration value settable through an environment variable.
+// Lists are given as comma separated values. Values of variables ending in _FILE are read from the file they point to.
+func setupEnvironment() error {
+	viper.SetEnvPrefix(envPrefix)
+	viper.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
+	viper.AutomaticEnv()
+
+	// viper only looks up environment variables for keys it already knows about,
+	// so every key has to be bound for a configuration without a file to work
+	for _, key := range configurationKeys(reflect.TypeOf(api.Configuration{}), "") {
+		if err := viper.BindEnv(key); err != nil {
+			return err
+		}
+		if err := readEnvFile(envName(key)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// configurationKeys lists the keys of every value in t, like Storage.MaxSize.
+func configurationKeys(t reflect.Type, prefix string) []string {
+	var keys []string
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.Tag.Get("mapstructure") == "-" {
+			continue
+		}
+		key := prefix + f.Name
+		if f.Type.Kind() == reflect.Struct {
+			keys = append(keys, configurationKeys(f.Type, key+".")...)
+		} else {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+func envName(key string) string {
+	return envPrefix + "_" + strings.ToUpper(strings.ReplaceAll(key, ".", "_"))
+}
+
+// readEnvFile sets the variable name to the contents of the file in name + "_FILE", if that is set and name isn't.
+// A single trailing newline is removed, as most editors add one.
+func readEnvFile(name string) error {
+	path, ok := os.LookupEnv(name + envFileSuffix)
+	if !ok {
+		return nil
+	}
+	if _, isSet := os.LookupEnv(name); isSet {
+		return fmt.Errorf("both %s and %s are set, only one of them can be used", name, name+envFileSuffix)
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read %s, %v", name+envFileSuffix, err)
+	}
+	v := strings.TrimSuffix(strings.TrimSuffix(string(b), "\n"), "\r")
+	return os.Setenv(name, v)
+}
+
+// stringToTrimmedSliceHook splits comma separated strings into a list, like viper's default hook,
+// but also trims the spaces around each value and drops empty ones, so
+// TYTANIUM_FILTER_SANITIZE="text/html, text/x-php" works as expected.
+func stringToTrimmedSliceHook(f reflect.Type, t reflect.Type, data interface{}) (interface{}, error) {
+	if f.Kind() != reflect.String || t.Kind() != reflect.Slice {
+		return data, nil
+	}
+	values := []string{}
+	for _, v := range strings.Split(data.(string), ",") {
+		if v = strings.TrimSpace(v); len(v) > 0 {
+			values = append(values, v)
+		}
+	}
+	return values, nil
+}
+
+// configurationDecodeHook is used when unmarshalling the configuration.
+var configurationDecodeHook = viper.DecodeHook(mapstructure.ComposeDecodeHookFunc(
+	mapstructure.StringToTimeDurationHookFunc(),
+	stringToTrimmedSliceHook,
+))
@@ -2,11 +2,37 @@ package global
 
 import (
 	"github.com/go-redis/redis/v8"
+	"github.com/valyala/fasthttp"
+	"sync/atomic"
+	"time"
 	"tytanium/api"
+	"tytanium/store"
 )
 
-// Configuration stores the current configuration for the server and should not be modified as it is not thread safe.
-var Configuration *api.Configuration
+// configuration holds the *api.Configuration currently in use.
+var configuration atomic.Value
+
+// Config returns the current configuration. The returned configuration is a snapshot shared by every request
+// and must not be modified; to change it, publish a new one with SetConfig.
+func Config() *api.Configuration {
+	c, _ := configuration.Load().(*api.Configuration)
+	return c
+}
+
+// SetConfig atomically replaces the current configuration.
+func SetConfig(c *api.Configuration) {
+	configuration.Store(c)
+}
 
 // RedisClient holds the Redis client used to communicate with Redis databases.
-var RedisClient *redis.Client
+// It's nil if Redis isn't used.
+var RedisClient redis.UniversalClient
+
+// Store keeps stats and traffic counters.
+var Store store.Store
+
+// Server is the HTTP server handling requests. It's used to read connection stats.
+var Server *fasthttp.Server
+
+// StartTime is when the server process started.
+var StartTime = time.Now()
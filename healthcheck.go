@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"tytanium/api"
+	"tytanium/constants"
+)
+
+// healthcheckCommand requests /readyz (or /healthz with -live) from the running server and exits with 0 if it's ready,
+// or 1 if it isn't, so it can be used as a Docker HEALTHCHECK without curl in the image.
+func healthcheckCommand(args []string) int {
+	fs := flag.NewFlagSet("healthcheck", flag.ExitOnError)
+	live := fs.Bool("live", false, "only check that the server is running (/healthz) instead of whether it's ready (/readyz)")
+	url := fs.String("url", "", "the URL to request (default is found from the Server section of the configuration)")
+	timeout := fs.Duration("timeout", 5*time.Second, "how long to wait for a response")
+	c, code := loadCommandConfiguration(fs, args)
+	if c == nil {
+		return code
+	}
+
+	path := constants.ReadyPath
+	if *live {
+		path = constants.HealthPath
+	}
+	client := &http.Client{
+		Timeout: *timeout,
+		Transport: &http.Transport{
+			// the server is checked by address, which its certificate usually isn't for
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		},
+	}
+	u := *url
+	if len(u) == 0 {
+		var unixSocket string
+		u, unixSocket = healthcheckURL(c, path)
+		if len(unixSocket) > 0 {
+			client.Transport.(*http.Transport).DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", unixSocket)
+			}
+		}
+	}
+
+	resp, err := client.Get(u)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unhealthy, %v\n", err)
+		return 1
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		fmt.Fprintf(os.Stderr, "Unhealthy, %s returned %s: %s\n", u, resp.Status, strings.TrimSpace(string(body)))
+		return 1
+	}
+	fmt.Println("Healthy")
+	return 0
+}
+
+// healthcheckURL returns the URL at which the server answers requests for path, according to the configuration:
+// the first Server.Listen address, the Unix socket if the server only listens on that, or Server.Port on localhost.
+// If the server has to be reached through the Unix socket, its path is returned as well.
+func healthcheckURL(c *api.Configuration, path string) (string, string) {
+	s := c.Server
+	if !s.SystemdSocket && len(s.Listen) == 0 && len(s.UnixSocket.Path) > 0 {
+		// Unix sockets never use TLS
+		return "http://localhost" + path, s.UnixSocket.Path
+	}
+
+	address := net.JoinHostPort("127.0.0.1", strconv.Itoa(s.Port))
+	if !s.SystemdSocket && len(s.Listen) > 0 {
+		host, port, _ := net.SplitHostPort(s.Listen[0])
+		switch host {
+		case "", "0.0.0.0":
+			host = "127.0.0.1"
+		case "::":
+			host = "::1"
+		}
+		address = net.JoinHostPort(host, port)
+	}
+	scheme := "http"
+	if s.TLS.Enabled {
+		scheme = "https"
+	}
+	return scheme + "://" + address + path, ""
+}
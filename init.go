@@ -7,46 +7,76 @@ import (
 	"github.com/spf13/viper"
 	"log"
 	"os"
+	"path/filepath"
+	"strings"
 	"time"
+	"tytanium/api"
 	"tytanium/constants"
 	"tytanium/global"
 	"tytanium/logger"
+	"tytanium/routes"
+	"tytanium/security"
+	"tytanium/store"
+	"tytanium/utils"
 )
 
+// logFiles holds every log file opened by openLogFile.
+var logFiles []*logger.RotatingFile
+
 const (
 	mebibyte                  = 1 << 20
 	minute                    = 60000
 	characterTagLengthEncoded = 12
 )
 
-func init() {
+// initServer loads the configuration and sets up everything the server needs before it starts listening.
+// setupConfiguration must be called first.
+func initServer() {
 	fmt.Printf("[ ⬢ Tytanium v%s ]\n", constants.Version)
 	initConfiguration()
 	initLogger()
+	initAccessLog()
 	checkStorage()
+	removeTempFiles()
+	loadLegacyIDs()
+	scanStorageUsage()
 	initRedis()
+	initStore()
+	initRateLimiter()
 	log.Println("[init] Initial checks completed")
 }
 
-func initConfiguration() {
-	viper.SetConfigName("config")
-	viper.AddConfigPath("./conf/")
-	viper.AutomaticEnv()
+// setupConfiguration tells viper where to find the configuration file and the environment variables,
+// and sets the default values. If configFile is empty, config.yml in ./conf/ is used if it exists.
+func setupConfiguration(configFile string) error {
+	if len(configFile) > 0 {
+		viper.SetConfigFile(configFile)
+	} else {
+		viper.SetConfigName("config")
+		viper.AddConfigPath("./conf/")
+	}
 	viper.SetConfigType("yml")
-
-	if err := viper.ReadInConfig(); err != nil {
-		if _, ok := err.(viper.ConfigFileNotFoundError); ok {
-			log.Fatalf("No config file set, %v", err)
-		} else {
-			log.Fatalf("Error reading config file, %v", err)
-		}
+	if err := setupEnvironment(); err != nil {
+		return err
 	}
 
 	viper.SetDefault("Storage.Directory", "files")
 	viper.SetDefault("Storage.MaxSize", 50*mebibyte)
 	viper.SetDefault("Storage.IDLength", 5)
+	viper.SetDefault("Storage.CollisionCheckAttempts", 10)
+	viper.SetDefault("Storage.Layout", utils.LayoutFlat)
+	viper.SetDefault("Storage.ShardLength", 2)
+	viper.SetDefault("Storage.MinFreeSpace", 100*mebibyte)
+	viper.SetDefault("Storage.MinFreePercent", 0)
+	viper.SetDefault("Storage.MaxTotalSize", 0)
+	viper.SetDefault("Storage.EvictOldest", false)
 
 	viper.SetDefault("RateLimit.ResetAfter", minute)
+	viper.SetDefault("RateLimit.Algorithm", security.AlgorithmFixedWindow)
+	viper.SetDefault("RateLimit.Backend", security.BackendRedis)
+	viper.SetDefault("RateLimit.Fallback", security.FallbackMemory)
+	viper.SetDefault("RateLimit.IPv4Prefix", 32)
+	viper.SetDefault("RateLimit.IPv6Prefix", 64)
 	viper.SetDefault("RateLimit.Path.Upload", 10)
 	viper.SetDefault("RateLimit.Path.Global", 60)
 	viper.SetDefault("RateLimit.Bandwidth.ResetAfter", 5*minute)
@@ -57,94 +87,333 @@ func initConfiguration() {
 	viper.SetDefault("Server.Concurrency", 128*4)
 	viper.SetDefault("Server.ReadTimeout", 5*minute)
 	viper.SetDefault("Server.WriteTimeout", 5*minute)
+	viper.SetDefault("Server.UnixSocket.Permissions", "0660")
+	viper.SetDefault("Server.ShutdownTimeout", 30000)
+	viper.SetDefault("Server.TLS.Enabled", false)
+	viper.SetDefault("Server.TLS.MinVersion", "1.2")
+	viper.SetDefault("Server.TLS.ReloadInterval", minute)
 
 	viper.SetDefault("StatsCollectionInterval", 30000)
 
 	viper.SetDefault("Logging.Enabled", true)
 	viper.SetDefault("Logging.LogFile", "log.txt")
+	viper.SetDefault("Logging.Level", "info")
+	viper.SetDefault("Logging.Format", "json")
+	viper.SetDefault("Logging.AccessLog.Enabled", false)
+	viper.SetDefault("Logging.AccessLog.File", "access.log")
+	viper.SetDefault("Logging.AccessLog.Format", "combined")
+	viper.SetDefault("Logging.AccessLog.StripEncryptionKey", true)
+	viper.SetDefault("Logging.Rotation.MaxSize", 0)
+	viper.SetDefault("Logging.Rotation.MaxAge", 0)
+	viper.SetDefault("Logging.Rotation.MaxBackups", 0)
+	viper.SetDefault("Logging.Rotation.Compress", false)
 
-	viper.SetDefault("Encryption.EncryptionKeyLength", 12)
+	viper.SetDefault("Security.ClientIPHeaders", []string{})
+	viper.SetDefault("Security.TrustUnixSocket", false)
 
-	err := viper.Unmarshal(&global.Configuration)
-	if err != nil {
-		log.Fatalf("Unable to decode into struct, %v", err)
-	}
+	viper.SetDefault("Redis.URI", "localhost:6379")
+	viper.SetDefault("Store.Type", store.TypeRedis)
+	viper.SetDefault("Store.Path", "tytanium.db")
 
-	if len(global.Configuration.Domain) == 0 {
-		log.Fatalf("Domain must be set in the configuration.")
-	}
+	viper.SetDefault("Encryption.EncryptionKeyLength", 12)
+	return nil
+}
 
-	if len(global.Configuration.Encryption.Nonce) == 0 {
-		log.Fatalf("You must set a nonce for encryption purposes. (Under Encryption.Nonce, use any string you want. It does not need to be secret.)")
+func initConfiguration() {
+	c, err := loadConfiguration()
+	if err != nil {
+		log.Fatalf("%v", err)
 	}
+	global.SetConfig(c)
 
-	if len(global.Configuration.Security.MasterKey) == 0 {
+	if len(c.Security.MasterKey) == 0 {
 		log.Println("Warning: Master key has not set in your configuration. Anyone on the Internet has permission to upload!")
-		if !global.Configuration.Security.DisableEmptyMasterKeyWarning {
+		if !c.Security.DisableEmptyMasterKeyWarning {
 			log.Println("Continuing in 5 seconds... (you can set Security.DisableEmptyMasterKeyWarning to true to disable this in the configuration)")
 			time.Sleep(time.Second * 5)
 		}
 	}
 
+	log.Println("[init] Loaded configuration")
+}
+
+// loadConfiguration reads the configuration file and returns a new, validated configuration.
+// It doesn't touch the configuration currently in use.
+func loadConfiguration() (*api.Configuration, error) {
+	// the configuration file is optional, everything can be set with environment variables instead;
+	// but if a file was given explicitly, it has to exist
+	if err := viper.ReadInConfig(); err != nil {
+		if _, ok := err.(viper.ConfigFileNotFoundError); !ok {
+			return nil, fmt.Errorf("Error reading config file, %v", err)
+		}
+	}
+
+	var c api.Configuration
+	if err := viper.Unmarshal(&c, configurationDecodeHook); err != nil {
+		return nil, fmt.Errorf("Unable to decode into struct, %v", err)
+	}
+
+	if err := validateConfiguration(&c); err != nil {
+		return nil, err
+	}
+
+	// checked by validateConfiguration
+	c.TrustedProxyNets, _ = utils.ParseCIDRs(c.Security.TrustedProxies)
+	c.RateLimitExemptNets, _ = utils.ParseCIDRs(c.RateLimit.Exempt.CIDRs)
+
+	// Path.Upload predates policies, so it keeps working as the last one
+	if c.RateLimit.Path.Upload > 0 {
+		c.RateLimit.Policies = append(c.RateLimit.Policies, api.RateLimitPolicy{Route: "/upload", Limit: c.RateLimit.Path.Upload})
+	}
+
+	c.PathLengthLimitBytes = pathLengthLimit(&c)
+
+	return &c, nil
+}
+
+// pathLengthLimit returns the longest request URI a link to a file can have.
+func pathLengthLimit(c *api.Configuration) int {
 	// Domain length + 1 byte for "/"
 	// ID length * 12 (%00%00%00%00)
 	// Extension length * 12
 	// 9 (?enc_key=) * 12
 	// Encryption key length * 12
-	constants.PathLengthLimitBytes =
-		(len(global.Configuration.Domain) + 1) +
-			(global.Configuration.Storage.IDLength * characterTagLengthEncoded) +
-			(constants.ExtensionLengthLimit * characterTagLengthEncoded) +
-			(9 * characterTagLengthEncoded) +
-			(global.Configuration.Encryption.EncryptionKeyLength * characterTagLengthEncoded)
-	log.Println("[init] Loaded configuration")
+	return (len(c.Domain) + 1) +
+		(c.Storage.IDLength * characterTagLengthEncoded) +
+		(constants.ExtensionLengthLimit * characterTagLengthEncoded) +
+		(9 * characterTagLengthEncoded) +
+		(c.Encryption.EncryptionKeyLength * characterTagLengthEncoded)
 }
 
 func initLogger() {
-	if !global.Configuration.Logging.Enabled {
+	if !global.Config().Logging.Enabled {
 		return
 	}
-	file, err := os.OpenFile(global.Configuration.Logging.LogFile, os.O_APPEND|os.O_RDWR|os.O_CREATE, 0644)
+	// both were checked by validateConfiguration
+	level, _ := logger.ParseLevel(global.Config().Logging.Level)
+	format, _ := logger.ParseFormat(global.Config().Logging.Format)
+
+	file, err := openLogFile(global.Config().Logging.LogFile)
 	if err != nil {
 		log.Fatalf("Failed to open log file! %v", err)
 	}
 
-	logger.InfoLogger = log.New(file, "info:", log.Ldate|log.Ltime|log.LUTC|log.Lshortfile)
-	logger.ErrorLogger = log.New(file, "error:", log.Ldate|log.Ltime|log.LUTC|log.Lshortfile)
+	logger.Init(file, level, format)
+
+	log.Println("[init] Logger initialized, output file: " + global.Config().Logging.LogFile)
+}
+
+func initAccessLog() {
+	c := global.Config().Logging.AccessLog
+	if !c.Enabled {
+		return
+	}
+
+	if c.File == "stdout" || c.File == "-" {
+		logger.InitAccess(os.Stdout)
+		log.Println("[init] Access log initialized, output: stdout")
+		return
+	}
 
-	log.Println("[init] Loggers initialized, output file: " + global.Configuration.Logging.LogFile)
+	file, err := openLogFile(c.File)
+	if err != nil {
+		log.Fatalf("Failed to open access log file! %v", err)
+	}
+	logger.InitAccess(file)
+
+	log.Println("[init] Access log initialized, output file: " + c.File)
+}
+
+// openLogFile opens a log file using the rotation settings under Logging.Rotation.
+// The file is also reopened by reopenLogFiles.
+func openLogFile(path string) (*logger.RotatingFile, error) {
+	c := global.Config().Logging.Rotation
+	f, err := logger.OpenRotatingFile(path, int64(c.MaxSize), time.Duration(c.MaxAge)*time.Millisecond, c.MaxBackups, c.Compress)
+	if err != nil {
+		return nil, err
+	}
+	logFiles = append(logFiles, f)
+	return f, nil
+}
+
+// reopenLogFiles reopens all log files, so they're written to again after being moved by something like logrotate.
+func reopenLogFiles() {
+	for _, f := range logFiles {
+		if err := f.Reopen(); err != nil {
+			log.Printf("Failed to reopen log file %s, %v", f.Path, err)
+		}
+	}
 }
 
 func checkStorage() {
-	i, err := os.Stat(global.Configuration.Storage.Directory)
+	i, err := os.Stat(global.Config().Storage.Directory)
 	if err != nil {
 		if os.IsNotExist(err) {
-			log.Fatalf("The storage directory %s doesn't exist. Did you forget to create it?", global.Configuration.Storage.Directory)
+			log.Fatalf("The storage directory %s doesn't exist. Did you forget to create it?", global.Config().Storage.Directory)
 		} else {
 			log.Fatalf("Can't stat the files directory, %v", err)
 		}
 	}
 	if i != nil && !i.IsDir() {
-		log.Fatalf("Specified storage path (%s) is not a directory or not usable.", global.Configuration.Storage.Directory)
+		log.Fatalf("Specified storage path (%s) is not a directory or not usable.", global.Config().Storage.Directory)
 	}
 	log.Println("[init] Storage directory is OK")
 }
 
+// removeTempFiles removes the temp files of uploads that were left behind when the server crashed or was killed.
+func removeTempFiles() {
+	removed, err := removeOrphanedTempFiles(global.Config().Storage.Directory, false)
+	if err != nil {
+		log.Printf("[init] Warning: failed to remove temp files left behind in the storage directory, %v", err)
+		return
+	}
+	if removed > 0 {
+		log.Printf("[init] Removed %d temp file(s) left behind by unfinished uploads", removed)
+	}
+}
+
+// sweepTempFiles removes temp files left behind by unfinished uploads every constants.TempFileSweepInterval, until
+// stop is closed. removeTempFiles only removes those old enough to have been left behind, as another instance may be
+// writing the others, so those left behind by a crash right before the start are removed here once they're old enough.
+func sweepTempFiles(stop <-chan struct{}) {
+	t := time.NewTicker(constants.TempFileSweepInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+		case <-stop:
+			return
+		}
+		removed, err := removeOrphanedTempFiles(global.Config().Storage.Directory, false)
+		if err != nil {
+			logger.Error("Failed to remove temp files left behind in the storage directory", logger.Fields{"error": err})
+		}
+		if removed > 0 {
+			logger.Info("Removed temp files left behind by unfinished uploads", logger.Fields{"count": removed})
+		}
+	}
+}
+
+// loadLegacyIDs lists the IDs of files stored with their extension in their name, so uploads don't use them again.
+func loadLegacyIDs() {
+	ids, err := routes.LoadLegacyIDs()
+	if err != nil {
+		log.Fatalf("Failed to list the files in the storage directory, %v", err)
+	}
+	if ids > 0 {
+		log.Printf("[init] Found %d file(s) named with their extension by an older version", ids)
+	}
+}
+
+// scanStorageUsage counts what's stored when Storage.MaxTotalSize is set, so uploads can be checked against it.
+func scanStorageUsage() {
+	if global.Config().Storage.MaxTotalSize <= 0 {
+		return
+	}
+	start := time.Now()
+	size, files, err := routes.ScanStorageUsage()
+	if err != nil {
+		log.Printf("[init] Warning: failed to count the size of the storage directory, %v", err)
+		return
+	}
+	log.Printf("[init] Storage directory holds %d bytes of the %d allowed, in %d file(s) (took %s)", size, global.Config().Storage.MaxTotalSize, files, time.Since(start))
+}
+
+// removeOrphanedTempFiles removes the temp files in dir older than constants.TempFileMaxAge, and returns how many
+// there were. Files of uploads this process is still writing are kept. With dryRun, they're only counted.
+func removeOrphanedTempFiles(dir string, dryRun bool) (int, error) {
+	cutoff := time.Now().Add(-constants.TempFileMaxAge)
+	removed := 0
+	err := filepath.Walk(dir, func(p string, i os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if i.IsDir() || !strings.HasPrefix(i.Name(), constants.TempFilePrefix) || !i.ModTime().Before(cutoff) || routes.IsIncompleteUpload(p) {
+			return nil
+		}
+		if !dryRun {
+			if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+		removed++
+		return nil
+	})
+	return removed, err
+}
+
+// initRedis connects to Redis if it's used, by RateLimit.Backend or Store.Type.
+// If Redis can't be reached, the server only refuses to start if rate limiting depends on it
+// (RateLimit.Fallback is fail_closed), as the client keeps trying to reconnect.
 func initRedis() {
+	c := global.Config()
+	if c.RateLimit.Backend != security.BackendRedis && c.Store.Type != store.TypeRedis {
+		log.Println("[init] Redis is not used")
+		return
+	}
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 
-	global.RedisClient = redis.NewClient(&redis.Options{
-		Addr:     global.Configuration.Redis.URI,
-		Password: global.Configuration.Redis.Password,
-		DB:       global.Configuration.Redis.DB,
-	})
+	client, err := newRedisClient(c)
+	if err != nil {
+		cancel()
+		log.Fatalf("Invalid Redis configuration, %v", err)
+	}
+	global.RedisClient = client
 
 	status := global.RedisClient.Ping(ctx).Err()
 	if status != nil {
 		cancel()
-		log.Fatalf("Could not ping Redis database, %v", status.Error())
+		if c.RateLimit.Backend == security.BackendRedis && c.RateLimit.Fallback == security.FallbackClosed {
+			log.Fatalf("Could not ping Redis database, %v", status.Error())
+		}
+		log.Printf("[init] Warning: could not ping Redis database, continuing without it until it's available. %v", status)
+		logger.Warn("Could not ping Redis database", logger.Fields{"error": status, "fallback": c.RateLimit.Fallback})
+		return
 	}
 	cancel()
 
 	log.Println("[init] Redis database connection established")
 }
+
+// initStore opens the store set in Store.Type.
+func initStore() {
+	s, err := openStore(global.Config(), global.RedisClient)
+	if err != nil {
+		log.Fatalf("Could not open the store, %v", err)
+	}
+	global.Store = s
+	if global.Config().Store.Type == store.TypeBolt {
+		log.Println("[init] Store opened at " + global.Config().Store.Path)
+	}
+}
+
+// openStore opens the store set in Store.Type. For Redis, client is used, or a new client if it's nil.
+func openStore(c *api.Configuration, client redis.UniversalClient) (store.Store, error) {
+	if c.Store.Type == store.TypeBolt {
+		return store.OpenBolt(c.Store.Path)
+	}
+	if client == nil {
+		var err error
+		client, err = newRedisClient(c)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &store.Redis{Client: client, Prefix: c.Redis.KeyPrefix}, nil
+}
+
+// initRateLimiter sets up the Limiter for RateLimit.Backend. initRedis and initStore must be called first.
+func initRateLimiter() {
+	switch global.Config().RateLimit.Backend {
+	case security.BackendRedis:
+		security.SetLimiter(&security.FallbackLimiter{
+			Primary: &security.RedisLimiter{Client: global.RedisClient, Prefix: global.Config().Redis.KeyPrefix},
+			Memory:  security.NewMemoryLimiter(),
+		})
+	case security.BackendBolt:
+		// checked by validateConfiguration
+		security.SetLimiter(&security.BoltLimiter{DB: global.Store.(*store.Bolt)})
+	default:
+		security.SetLimiter(security.NewMemoryLimiter())
+	}
+}
@@ -0,0 +1,89 @@
+package listener
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+)
+
+// systemdFirstFD is the first file descriptor passed by systemd socket activation (SD_LISTEN_FDS_START).
+const systemdFirstFD = 3
+
+// TCP listens on each of the given TCP addresses, like 127.0.0.1:3030 or [::1]:3030.
+func TCP(addresses []string) ([]net.Listener, error) {
+	listeners := make([]net.Listener, 0, len(addresses))
+	for _, a := range addresses {
+		ln, err := net.Listen("tcp", a)
+		if err != nil {
+			Close(listeners)
+			return nil, err
+		}
+		listeners = append(listeners, ln)
+	}
+	return listeners, nil
+}
+
+// Unix listens on a Unix domain socket at path, with the given file mode.
+// A socket file left behind at path by a previous run is removed first.
+func Unix(path string, mode os.FileMode) (net.Listener, error) {
+	if i, err := os.Lstat(path); err == nil {
+		if i.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		_ = ln.Close()
+		return nil, fmt.Errorf("cannot chmod %#o for %s, %v", mode, path, err)
+	}
+	return ln, nil
+}
+
+// Systemd returns the sockets passed to the process by systemd socket activation (see sd_listen_fds(3)).
+func Systemd() ([]net.Listener, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, fmt.Errorf("no sockets were passed by systemd (LISTEN_PID is not set to this process)")
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n < 1 {
+		return nil, fmt.Errorf("no sockets were passed by systemd (LISTEN_FDS is %q)", os.Getenv("LISTEN_FDS"))
+	}
+	// so child processes don't think the sockets are meant for them
+	_ = os.Unsetenv("LISTEN_PID")
+	_ = os.Unsetenv("LISTEN_FDS")
+	_ = os.Unsetenv("LISTEN_FDNAMES")
+
+	listeners := make([]net.Listener, 0, n)
+	for fd := systemdFirstFD; fd < systemdFirstFD+n; fd++ {
+		f := os.NewFile(uintptr(fd), "LISTEN_FD_"+strconv.Itoa(fd))
+		ln, err := net.FileListener(f)
+		// FileListener duplicates the descriptor, so the original is closed either way
+		_ = f.Close()
+		if err != nil {
+			Close(listeners)
+			return nil, fmt.Errorf("socket %d passed by systemd can't be used, %v", fd, err)
+		}
+		listeners = append(listeners, ln)
+	}
+	return listeners, nil
+}
+
+// IsUnix reports whether ln is a Unix domain socket.
+func IsUnix(ln net.Listener) bool {
+	return ln.Addr().Network() == "unix"
+}
+
+// Close closes every listener, ignoring errors.
+func Close(listeners []net.Listener) {
+	for _, ln := range listeners {
+		_ = ln.Close()
+	}
+}
@@ -0,0 +1,25 @@
+package listener
+
+import (
+	"github.com/valyala/fasthttp"
+	"net"
+	"strconv"
+)
+
+// RedirectToHTTPS returns a handler sending every request to the same URI over HTTPS. If host (like example.com or
+// example.com:8443) is empty, requests are sent to the host they were made to, on httpsPort.
+func RedirectToHTTPS(host string, httpsPort int) fasthttp.RequestHandler {
+	return func(ctx *fasthttp.RequestCtx) {
+		target := host
+		if len(target) == 0 {
+			target = string(ctx.Host())
+			if h, _, err := net.SplitHostPort(target); err == nil {
+				target = h
+			}
+			if httpsPort != 443 {
+				target = net.JoinHostPort(target, strconv.Itoa(httpsPort))
+			}
+		}
+		ctx.Redirect("https://"+target+string(ctx.RequestURI()), fasthttp.StatusMovedPermanently)
+	}
+}
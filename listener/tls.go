@@ -0,0 +1,155 @@
+package listener
+
+import (
+	"crypto/tls"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+	"tytanium/logger"
+)
+
+// CertReloader serves a certificate loaded from a pair of files, and loads it again when either file changes.
+// Use GetCertificate as tls.Config.GetCertificate.
+type CertReloader struct {
+	certFile string
+	keyFile  string
+
+	mu          sync.RWMutex
+	cert        *tls.Certificate
+	certModTime time.Time
+	keyModTime  time.Time
+}
+
+// NewCertReloader loads the certificate and key at the given paths.
+func NewCertReloader(certFile string, keyFile string) (*CertReloader, error) {
+	r := &CertReloader{certFile: certFile, keyFile: keyFile}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Reload loads the certificate and key again. If they can't be loaded, the previous certificate stays in use.
+func (r *CertReloader) Reload() error {
+	certInfo, err := os.Stat(r.certFile)
+	if err != nil {
+		return err
+	}
+	keyInfo, err := os.Stat(r.keyFile)
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("cannot load TLS key pair from %s and %s, %v", r.certFile, r.keyFile, err)
+	}
+
+	r.mu.Lock()
+	r.cert = &cert
+	r.certModTime = certInfo.ModTime()
+	r.keyModTime = keyInfo.ModTime()
+	r.mu.Unlock()
+	return nil
+}
+
+// GetCertificate returns the certificate currently in use.
+func (r *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert, nil
+}
+
+// Watch checks the certificate and key files for changes every interval, reloading them if they have changed,
+// until stop is closed.
+func (r *CertReloader) Watch(interval time.Duration, stop <-chan struct{}) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+			if r.changed() {
+				if err := r.Reload(); err != nil {
+					logger.Error("Failed to reload the TLS certificate, keeping the current one", logger.Fields{"error": err})
+				} else {
+					logger.Info("TLS certificate reloaded", logger.Fields{"file": r.certFile})
+				}
+			}
+		}
+	}
+}
+
+func (r *CertReloader) changed() bool {
+	certInfo, err := os.Stat(r.certFile)
+	if err != nil {
+		return false
+	}
+	keyInfo, err := os.Stat(r.keyFile)
+	if err != nil {
+		return false
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return !certInfo.ModTime().Equal(r.certModTime) || !keyInfo.ModTime().Equal(r.keyModTime)
+}
+
+// TLSVersion converts a version like "1.2" to its crypto/tls constant.
+func TLSVersion(v string) (uint16, error) {
+	switch v {
+	case "1.0":
+		return tls.VersionTLS10, nil
+	case "1.1":
+		return tls.VersionTLS11, nil
+	case "", "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	}
+	return 0, fmt.Errorf("unknown TLS version %q, must be 1.0, 1.1, 1.2 or 1.3", v)
+}
+
+// CipherSuites converts cipher suite names like TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 to their IDs.
+// If names is empty, nil is returned so Go's defaults are used.
+func CipherSuites(names []string) ([]uint16, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+	known := map[string]uint16{}
+	for _, s := range tls.CipherSuites() {
+		known[s.Name] = s.ID
+	}
+	for _, s := range tls.InsecureCipherSuites() {
+		known[s.Name] = s.ID
+	}
+
+	ids := make([]uint16, 0, len(names))
+	for _, n := range names {
+		id, ok := known[n]
+		if !ok {
+			return nil, fmt.Errorf("unknown cipher suite %q", n)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// NewTLSConfig returns a TLS configuration serving the certificate of r, with the given minimum version
+// and cipher suites (names as accepted by CipherSuites). Only HTTP/1.1 is offered, as that's all fasthttp speaks.
+func NewTLSConfig(r *CertReloader, minVersion string, cipherSuites []string) (*tls.Config, error) {
+	v, err := TLSVersion(minVersion)
+	if err != nil {
+		return nil, err
+	}
+	ciphers, err := CipherSuites(cipherSuites)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		GetCertificate: r.GetCertificate,
+		MinVersion:     v,
+		CipherSuites:   ciphers,
+		NextProtos:     []string{"http/1.1"},
+	}, nil
+}
@@ -0,0 +1,35 @@
+package logger
+
+import (
+	"io"
+	"sync"
+)
+
+var (
+	accessMu  sync.Mutex
+	accessOut io.Writer
+)
+
+// InitAccess sets where access log lines are written to. If w is nil, access log lines are discarded.
+func InitAccess(w io.Writer) {
+	accessMu.Lock()
+	defer accessMu.Unlock()
+	accessOut = w
+}
+
+// AccessEnabled reports whether access log lines are being written anywhere.
+func AccessEnabled() bool {
+	accessMu.Lock()
+	defer accessMu.Unlock()
+	return accessOut != nil
+}
+
+// Access writes a single, already formatted line to the access log.
+func Access(line []byte) {
+	accessMu.Lock()
+	defer accessMu.Unlock()
+	if accessOut == nil {
+		return
+	}
+	_, _ = accessOut.Write(line)
+}
@@ -1,8 +1,170 @@
 package logger
 
-import "log"
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Level is the severity of a log entry.
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+// Format is how log entries are encoded.
+type Format int
+
+const (
+	// FormatJSON writes one JSON object per line.
+	FormatJSON Format = iota
+	// FormatLogfmt writes key=value pairs, one entry per line.
+	FormatLogfmt
+)
+
+// Fields are additional key/value pairs attached to a log entry.
+type Fields map[string]interface{}
 
 var (
-	InfoLogger  *log.Logger
-	ErrorLogger *log.Logger
+	mu       sync.Mutex
+	out      io.Writer
+	minLevel = LevelInfo
+	format   = FormatJSON
 )
+
+// Init sets where log entries are written to, the minimum level to write and the format to use.
+// Until Init is called (or if w is nil), all log entries are discarded.
+func Init(w io.Writer, level Level, f Format) {
+	mu.Lock()
+	defer mu.Unlock()
+	out = w
+	minLevel = level
+	format = f
+}
+
+// Configure changes the minimum level to write and the format to use, keeping the current output.
+func Configure(level Level, f Format) {
+	mu.Lock()
+	defer mu.Unlock()
+	minLevel = level
+	format = f
+}
+
+// ParseLevel converts a level name (debug, info, warn, error) to a Level.
+func ParseLevel(s string) (Level, error) {
+	switch strings.ToLower(s) {
+	case "debug":
+		return LevelDebug, nil
+	case "", "info":
+		return LevelInfo, nil
+	case "warn", "warning":
+		return LevelWarn, nil
+	case "error":
+		return LevelError, nil
+	}
+	return LevelInfo, fmt.Errorf("unknown log level %q", s)
+}
+
+// ParseFormat converts a format name (json, logfmt) to a Format.
+func ParseFormat(s string) (Format, error) {
+	switch strings.ToLower(s) {
+	case "", "json":
+		return FormatJSON, nil
+	case "logfmt":
+		return FormatLogfmt, nil
+	}
+	return FormatJSON, fmt.Errorf("unknown log format %q", s)
+}
+
+func (l Level) String() string {
+	switch l {
+	case LevelDebug:
+		return "debug"
+	case LevelWarn:
+		return "warn"
+	case LevelError:
+		return "error"
+	}
+	return "info"
+}
+
+// Debug writes a log entry with LevelDebug.
+func Debug(msg string, fields Fields) {
+	write(LevelDebug, msg, fields)
+}
+
+// Info writes a log entry with LevelInfo.
+func Info(msg string, fields Fields) {
+	write(LevelInfo, msg, fields)
+}
+
+// Warn writes a log entry with LevelWarn.
+func Warn(msg string, fields Fields) {
+	write(LevelWarn, msg, fields)
+}
+
+// Error writes a log entry with LevelError.
+func Error(msg string, fields Fields) {
+	write(LevelError, msg, fields)
+}
+
+func write(level Level, msg string, fields Fields) {
+	mu.Lock()
+	defer mu.Unlock()
+	if out == nil || level < minLevel {
+		return
+	}
+
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var b bytes.Buffer
+	t := time.Now().UTC().Format(time.RFC3339Nano)
+	if format == FormatLogfmt {
+		b.WriteString("time=" + t + " level=" + level.String() + " msg=" + logfmtValue(msg))
+		for _, k := range keys {
+			b.WriteString(" " + k + "=" + logfmtValue(fields[k]))
+		}
+	} else {
+		b.WriteString(`{"time":"` + t + `","level":"` + level.String() + `","msg":` + jsonValue(msg))
+		for _, k := range keys {
+			b.WriteString("," + jsonValue(k) + ":" + jsonValue(fields[k]))
+		}
+		b.WriteByte('}')
+	}
+	b.WriteByte('\n')
+
+	_, _ = out.Write(b.Bytes())
+}
+
+func jsonValue(v interface{}) string {
+	if err, ok := v.(error); ok {
+		v = err.Error()
+	}
+	j, err := json.Marshal(v)
+	if err != nil {
+		j, _ = json.Marshal(fmt.Sprint(v))
+	}
+	return string(j)
+}
+
+func logfmtValue(v interface{}) string {
+	s := fmt.Sprint(v)
+	if s == "" || strings.ContainsAny(s, " =\"\t\r\n") {
+		return strconv.Quote(s)
+	}
+	return s
+}
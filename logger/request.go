@@ -0,0 +1,21 @@
+package logger
+
+import (
+	"github.com/valyala/fasthttp"
+	"tytanium/constants"
+	"tytanium/utils"
+)
+
+// RequestFields returns the fields identifying the request handled by ctx (request ID, client IP and route),
+// along with any extra fields given. The encryption key is never included.
+func RequestFields(ctx *fasthttp.RequestCtx, extra Fields) Fields {
+	f := Fields{
+		"request_id": ctx.UserValue(constants.UserValueRequestID),
+		"ip":         utils.GetIP(ctx),
+		"route":      utils.PathForLog(ctx.RequestURI()),
+	}
+	for k, v := range extra {
+		f[k] = v
+	}
+	return f
+}
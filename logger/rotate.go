@@ -0,0 +1,196 @@
+package logger
+
+import (
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	rotatedTimeFormat = "20060102T150405.000Z"
+	compressedSuffix  = ".gz"
+)
+
+// RotatingFile is an io.Writer appending to a file, which is rotated once it grows larger than MaxSize bytes
+// or gets older than MaxAge. Rotated files are renamed to <name>.<UTC time>, optionally gzipped,
+// and only the newest MaxBackups of them are kept.
+// A zero value for MaxSize, MaxAge or MaxBackups disables that limit.
+type RotatingFile struct {
+	Path       string
+	MaxSize    int64
+	MaxAge     time.Duration
+	MaxBackups int
+	Compress   bool
+
+	mu       sync.Mutex
+	millMu   sync.Mutex
+	file     *os.File
+	size     int64
+	openedAt time.Time
+}
+
+// OpenRotatingFile opens (or creates) the file at path for appending.
+func OpenRotatingFile(path string, maxSize int64, maxAge time.Duration, maxBackups int, compress bool) (*RotatingFile, error) {
+	r := &RotatingFile{
+		Path:       path,
+		MaxSize:    maxSize,
+		MaxAge:     maxAge,
+		MaxBackups: maxBackups,
+		Compress:   compress,
+	}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Write appends p to the file, rotating it first if p would push it over MaxSize or if it's older than MaxAge.
+func (r *RotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.file == nil {
+		if err := r.open(); err != nil {
+			return 0, err
+		}
+	}
+	if (r.MaxSize > 0 && r.size > 0 && r.size+int64(len(p)) > r.MaxSize) ||
+		(r.MaxAge > 0 && time.Since(r.openedAt) >= r.MaxAge) {
+		if err := r.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := r.file.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+// Reopen closes and reopens the file at Path. Use it after the file has been moved away by an external tool like logrotate.
+func (r *RotatingFile) Reopen() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.close(); err != nil {
+		return err
+	}
+	return r.open()
+}
+
+// Rotate rotates the file right away.
+func (r *RotatingFile) Rotate() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.rotate()
+}
+
+// Close closes the file. Writing to it afterwards will open it again.
+func (r *RotatingFile) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.close()
+}
+
+func (r *RotatingFile) open() error {
+	f, err := os.OpenFile(r.Path, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	i, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return err
+	}
+	r.file = f
+	r.size = i.Size()
+	r.openedAt = time.Now()
+	return nil
+}
+
+func (r *RotatingFile) close() error {
+	if r.file == nil {
+		return nil
+	}
+	err := r.file.Close()
+	r.file = nil
+	return err
+}
+
+func (r *RotatingFile) rotate() error {
+	if err := r.close(); err != nil {
+		return err
+	}
+	rotatedPath := r.Path + "." + time.Now().UTC().Format(rotatedTimeFormat)
+	if err := os.Rename(r.Path, rotatedPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := r.open(); err != nil {
+		return err
+	}
+	go r.mill(rotatedPath)
+	return nil
+}
+
+// mill compresses a freshly rotated file and removes backups beyond MaxBackups.
+// It runs in the background so writers aren't blocked by it.
+func (r *RotatingFile) mill(rotatedPath string) {
+	r.millMu.Lock()
+	defer r.millMu.Unlock()
+
+	if r.Compress {
+		if err := compressFile(rotatedPath); err != nil {
+			Error("Failed to compress rotated log file", Fields{"file": rotatedPath, "error": err})
+		}
+	}
+	if r.MaxBackups <= 0 {
+		return
+	}
+
+	backups, err := filepath.Glob(r.Path + ".*")
+	if err != nil {
+		return
+	}
+	valid := backups[:0]
+	for _, b := range backups {
+		stamp := strings.TrimSuffix(strings.TrimPrefix(b, r.Path+"."), compressedSuffix)
+		if _, err := time.Parse(rotatedTimeFormat, stamp); err == nil {
+			valid = append(valid, b)
+		}
+	}
+	// the timestamps sort lexically, so the newest backups end up last
+	sort.Strings(valid)
+	for i := 0; i < len(valid)-r.MaxBackups; i++ {
+		_ = os.Remove(valid[i])
+	}
+}
+
+func compressFile(path string) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = src.Close()
+	}()
+
+	dst, err := os.OpenFile(path+compressedSuffix, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	gz := gzip.NewWriter(dst)
+	if _, err = io.Copy(gz, src); err == nil {
+		err = gz.Close()
+	}
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(path + compressedSuffix)
+		return err
+	}
+	return os.Remove(path)
+}
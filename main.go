@@ -4,30 +4,73 @@ import (
 	_ "embed"
 	"github.com/valyala/fasthttp"
 	"log"
+	"net"
 	"os"
 	"os/signal"
 	"strconv"
+	"strings"
+	"syscall"
 	"time"
+	"tytanium/api"
 	"tytanium/constants"
 	"tytanium/global"
+	"tytanium/listener"
 	"tytanium/logger"
 	"tytanium/middleware"
+	"tytanium/routes"
+	"tytanium/store"
 )
 
 func main() {
+	os.Exit(run(os.Args[1:]))
+}
+
+// openListeners opens the sockets set in the Server section of the configuration: the sockets passed by systemd if
+// Server.SystemdSocket is true, otherwise every Server.Listen address and Server.UnixSocket.Path. If neither of those
+// is set, the server listens on Server.Port on all interfaces.
+func openListeners() ([]net.Listener, error) {
+	c := global.Config().Server
+	if c.SystemdSocket {
+		return listener.Systemd()
+	}
+
+	addresses := c.Listen
+	if len(addresses) == 0 && len(c.UnixSocket.Path) == 0 {
+		addresses = []string{":" + strconv.Itoa(c.Port)}
+	}
+	listeners, err := listener.TCP(addresses)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(c.UnixSocket.Path) > 0 {
+		// checked by validateConfiguration
+		mode, _ := strconv.ParseUint(c.UnixSocket.Permissions, 8, 32)
+		ln, err := listener.Unix(c.UnixSocket.Path, os.FileMode(mode))
+		if err != nil {
+			listener.Close(listeners)
+			return nil, err
+		}
+		listeners = append(listeners, ln)
+	}
+	return listeners, nil
+}
+
+// serve starts the server and blocks until it's shut down. initServer must be called first.
+func serve() int {
 	s := &fasthttp.Server{
 		ErrorHandler: nil,
 		// yo what da fuck
-		Handler:                       middleware.HandleCORS(middleware.LimitPath(middleware.HandleHTTPRequest)),
+		Handler:                       middleware.LogRequest(middleware.AccessLog(middleware.HandleCORS(middleware.LimitPath(middleware.HandleHTTPRequest)))),
 		HeaderReceived:                nil,
 		ContinueHandler:               nil,
-		Concurrency:                   global.Configuration.Server.Concurrency,
+		Concurrency:                   global.Config().Server.Concurrency,
 		DisableKeepalive:              false,
-		ReadTimeout:                   time.Millisecond * time.Duration(global.Configuration.Server.ReadTimeout),
-		WriteTimeout:                  time.Millisecond * time.Duration(global.Configuration.Server.WriteTimeout),
+		ReadTimeout:                   time.Millisecond * time.Duration(global.Config().Server.ReadTimeout),
+		WriteTimeout:                  time.Millisecond * time.Duration(global.Config().Server.WriteTimeout),
 		TCPKeepalive:                  false,
 		TCPKeepalivePeriod:            0,
-		MaxRequestBodySize:            int(global.Configuration.Storage.MaxSize) + constants.RequestMaxBodySizePadding,
+		MaxRequestBodySize:            int(global.Config().Storage.MaxSize) + constants.RequestMaxBodySizePadding,
 		ReduceMemoryUsage:             false,
 		GetOnly:                       false,
 		DisablePreParseMultipartForm:  true,
@@ -38,33 +81,154 @@ func main() {
 		NoDefaultContentType:          true,
 		KeepHijackedConns:             false,
 	}
+	global.Server = s
 
-	portAsString := strconv.Itoa(global.Configuration.Server.Port)
-	log.Println("Server is listening for new requests on port " + portAsString)
+	// SIGTERM is what docker stop and systemd send
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
 
-	if global.Configuration.Logging.Enabled {
-		logger.InfoLogger.Printf("Server online, port %s, version %s", portAsString, constants.Version)
+	if global.Config().WatchConfig {
+		watchConfiguration()
 	}
 
-	stop := make(chan os.Signal)
-	signal.Notify(stop, os.Interrupt)
-
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
 	go func() {
-		if err := s.ListenAndServe(":" + portAsString); err != nil {
-			log.Fatalf("Listen error: %v\n", err)
+		for range hup {
+			reopenLogFiles()
+			logger.Info("Log files reopened", nil)
+			_ = reloadConfiguration()
 		}
 	}()
 
-	<-stop
-	log.Println("Server is shutting down, please wait")
-	logger.InfoLogger.Println("Server started graceful shutdown")
+	listeners, err := openListeners()
+	if err != nil {
+		log.Fatalf("Listen error: %v\n", err)
+	}
+	addresses := make([]string, 0, len(listeners))
+	for _, ln := range listeners {
+		addresses = append(addresses, ln.Addr().Network()+":"+ln.Addr().String())
+	}
+	log.Println("Server is listening for new requests on " + strings.Join(addresses, ", "))
+	logger.Info("Server online", logger.Fields{"listeners": addresses, "version": constants.Version})
+
+	// nothing else can write to the bolt database while it's open here
+	stopStats := make(chan struct{})
+	if global.Config().Store.Type == store.TypeBolt {
+		go collectStats(stopStats)
+	}
+	stopSweep := make(chan struct{})
+	go sweepTempFiles(stopSweep)
+
+	var redirectServer *fasthttp.Server
+	stopCertWatch := make(chan struct{})
+	tlsConfig := global.Config().Server.TLS
+	if tlsConfig.Enabled {
+		certs, err := listener.NewCertReloader(tlsConfig.CertFile, tlsConfig.KeyFile)
+		if err != nil {
+			log.Fatalf("Failed to load the TLS certificate, %v", err)
+		}
+		s.TLSConfig, err = listener.NewTLSConfig(certs, tlsConfig.MinVersion, tlsConfig.CipherSuites)
+		if err != nil {
+			log.Fatalf("Invalid TLS configuration, %v", err)
+		}
+		if tlsConfig.ReloadInterval > 0 {
+			go certs.Watch(time.Duration(tlsConfig.ReloadInterval)*time.Millisecond, stopCertWatch)
+		}
+
+		if tlsConfig.RedirectHTTPPort > 0 {
+			redirectServer = &fasthttp.Server{
+				Handler:               listener.RedirectToHTTPS(tlsConfig.RedirectHost, httpsPort(global.Config())),
+				ReadTimeout:           s.ReadTimeout,
+				WriteTimeout:          s.WriteTimeout,
+				NoDefaultServerHeader: true,
+			}
+			redirectPort := strconv.Itoa(tlsConfig.RedirectHTTPPort)
+			log.Println("Redirecting HTTP requests on port " + redirectPort + " to HTTPS")
+			go func() {
+				if err := redirectServer.ListenAndServe(":" + redirectPort); err != nil {
+					log.Fatalf("Listen error: %v\n", err)
+				}
+			}()
+		}
+	}
+
+	for _, ln := range listeners {
+		go func(ln net.Listener) {
+			var err error
+			// Unix sockets are only reachable from the same host (usually by a reverse proxy), so they stay plain HTTP
+			if tlsConfig.Enabled && !listener.IsUnix(ln) {
+				// the certificate comes from TLSConfig.GetCertificate, so no files are passed here
+				err = s.ServeTLS(ln, "", "")
+			} else {
+				err = s.Serve(ln)
+			}
+			if err != nil {
+				log.Fatalf("Listen error: %v\n", err)
+			}
+		}(ln)
+	}
+
+	sig := <-stop
+	shutdownTimeout := time.Duration(global.Config().Server.ShutdownTimeout) * time.Millisecond
+	log.Printf("Server is shutting down, please wait (up to %s for requests in progress, signal again to stop now)", shutdownTimeout)
+	logger.Info("Server started graceful shutdown", logger.Fields{"signal": sig.String(), "timeout": shutdownTimeout.Milliseconds()})
+
+	close(stopCertWatch)
+	close(stopStats)
+	close(stopSweep)
+	if redirectServer != nil {
+		_ = redirectServer.Shutdown()
+	}
+
+	// Shutdown stops accepting connections and waits for the open ones to finish, for as long as that takes
+	shutdown := make(chan error, 1)
+	go func() {
+		shutdown <- s.Shutdown()
+	}()
+	var deadline <-chan time.Time
+	if shutdownTimeout > 0 {
+		deadline = time.After(shutdownTimeout)
+	}
+	select {
+	case err := <-shutdown:
+		if err != nil {
+			logger.Error("Server failed to shut down gracefully", logger.Fields{"error": err})
+			log.Fatalf("Failed to shutdown gracefully: %v\n", err)
+		}
+	case <-deadline:
+		return abortShutdown("the shutdown timeout was reached")
+	case sig = <-stop:
+		return abortShutdown("received " + sig.String() + " again")
+	}
 
-	if err := s.Shutdown(); err != nil {
-		logger.ErrorLogger.Printf("Server failed to shut down gracefully: %v", err)
-		log.Fatalf("Failed to shutdown gracefully: %v\n", err)
+	if err := global.Store.Close(); err != nil {
+		logger.Error("Failed to close the store", logger.Fields{"error": err})
 	}
 
 	log.Println("Shut down. See you next time!")
-	logger.InfoLogger.Println("Server shut down successfully")
-	os.Exit(0)
+	logger.Info("Server shut down successfully", nil)
+	return 0
+}
+
+// httpsPort returns the port HTTP requests are redirected to when Server.TLS.RedirectHost isn't set:
+// the port of the first Server.Listen address, or Server.Port.
+func httpsPort(c *api.Configuration) int {
+	if len(c.Server.Listen) > 0 {
+		if _, port, err := net.SplitHostPort(c.Server.Listen[0]); err == nil {
+			if p, err := strconv.Atoi(port); err == nil {
+				return p
+			}
+		}
+	}
+	return c.Server.Port
+}
+
+// abortShutdown stops the server without waiting for requests in progress any longer.
+// Files of uploads that didn't finish are removed, as they can't be decrypted anyway.
+func abortShutdown(reason string) int {
+	removed := routes.RemoveIncompleteUploads()
+	log.Printf("Stopped without waiting for requests in progress, as %s. Removed %d incomplete upload(s)", reason, removed)
+	logger.Warn("Server stopped before requests in progress finished", logger.Fields{"reason": reason, "removed_uploads": removed})
+	return 1
 }
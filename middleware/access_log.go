@@ -0,0 +1,122 @@
+package middleware
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/valyala/fasthttp"
+	"strconv"
+	"time"
+	"tytanium/constants"
+	"tytanium/global"
+	"tytanium/logger"
+	"tytanium/utils"
+)
+
+const (
+	AccessLogFormatCommon   = "common"
+	AccessLogFormatCombined = "combined"
+	AccessLogFormatJSON     = "json"
+
+	clfTimeFormat = "02/Jan/2006:15:04:05 -0700"
+)
+
+// accessLogEntry is a single request written to the access log in JSON format.
+type accessLogEntry struct {
+	Time      string  `json:"time"`
+	RequestID string  `json:"request_id,omitempty"`
+	IP        string  `json:"ip"`
+	Method    string  `json:"method"`
+	URI       string  `json:"uri"`
+	Protocol  string  `json:"protocol"`
+	Status    int     `json:"status"`
+	Bytes     int     `json:"bytes"`
+	Duration  float64 `json:"duration"`
+	Referer   string  `json:"referer,omitempty"`
+	UserAgent string  `json:"user_agent,omitempty"`
+}
+
+// AccessLog writes a line to the access log for every request, in the format set by Logging.AccessLog.Format.
+func AccessLog(h fasthttp.RequestHandler) fasthttp.RequestHandler {
+	return func(ctx *fasthttp.RequestCtx) {
+		if !logger.AccessEnabled() {
+			h(ctx)
+			return
+		}
+		c := global.Config().Logging.AccessLog
+		start := time.Now()
+		// handlers may rewrite the URI, so everything about the request is captured beforehand
+		e := accessLogEntry{
+			IP:        utils.GetIP(ctx),
+			Method:    string(ctx.Method()),
+			URI:       utils.URIForLog(ctx.RequestURI(), c.StripEncryptionKey),
+			Protocol:  string(ctx.Request.Header.Protocol()),
+			Referer:   string(ctx.Request.Header.Referer()),
+			UserAgent: string(ctx.Request.Header.UserAgent()),
+		}
+		if c.AnonymizeIP {
+			e.IP = utils.AnonymizeIP(e.IP)
+		}
+		if c.StripEncryptionKey && len(e.Referer) > 0 {
+			e.Referer = stripRefererKey(e.Referer)
+		}
+
+		h(ctx)
+
+		e.Status = ctx.Response.StatusCode()
+		e.Bytes = len(ctx.Response.Body())
+		e.Duration = float64(time.Since(start)) / float64(time.Millisecond)
+		if id, ok := ctx.UserValue(constants.UserValueRequestID).(string); ok {
+			e.RequestID = id
+		}
+
+		logger.Access(formatAccessLogEntry(&e, start, c.Format))
+	}
+}
+
+func formatAccessLogEntry(e *accessLogEntry, start time.Time, format string) []byte {
+	if format == AccessLogFormatJSON {
+		e.Time = start.UTC().Format(time.RFC3339Nano)
+		b, err := json.Marshal(e)
+		if err == nil {
+			return append(b, '\n')
+		}
+	}
+
+	var b bytes.Buffer
+	b.WriteString(e.IP)
+	b.WriteString(" - - [")
+	b.WriteString(start.Format(clfTimeFormat))
+	b.WriteString("] \"")
+	b.WriteString(e.Method + " " + e.URI + " " + e.Protocol)
+	b.WriteString("\" ")
+	b.WriteString(strconv.Itoa(e.Status))
+	b.WriteByte(' ')
+	if e.Bytes == 0 {
+		b.WriteByte('-')
+	} else {
+		b.WriteString(strconv.Itoa(e.Bytes))
+	}
+	if format != AccessLogFormatCommon {
+		b.WriteString(" " + clfQuote(e.Referer) + " " + clfQuote(e.UserAgent))
+	}
+	b.WriteByte('\n')
+	return b.Bytes()
+}
+
+// clfQuote quotes a header value for the Combined Log Format, using "-" if it's empty.
+func clfQuote(s string) string {
+	if len(s) == 0 {
+		return `"-"`
+	}
+	return strconv.Quote(s)
+}
+
+// stripRefererKey removes the encryption key from a Referer pointing to a file on this server.
+func stripRefererKey(referer string) string {
+	u := fasthttp.AcquireURI()
+	defer fasthttp.ReleaseURI(u)
+	if err := u.Parse(nil, []byte(referer)); err != nil {
+		return ""
+	}
+	return string(u.Scheme()) + "://" + string(u.Host()) + utils.URIForLog(u.RequestURI(), true)
+}
@@ -3,9 +3,12 @@ package middleware
 import (
 	"fmt"
 	"github.com/valyala/fasthttp"
+	"strconv"
 	"strings"
+	"time"
 	"tytanium/constants"
 	"tytanium/global"
+	"tytanium/logger"
 	"tytanium/response"
 	"tytanium/routes"
 	"tytanium/security"
@@ -13,69 +16,116 @@ import (
 )
 
 // LimitPath generally handles all paths.
-// IPs will be stored like 0_192.168.1.1 for path 0, 1_192.168.1.1 for path 1, and so on.
-// Bandwidth checking for uploading is set as BW_UP_192.168.1.1, for another example.
+// Every request counts towards the global limit, stored like G_192.168.1.1, and towards the first policy in
+// RateLimit.Policies whose route matches, stored like P_/upload_192.168.1.1. Clients using the master key are
+// limited by key instead of IP, with their own limits if set. Exempt clients aren't limited at all.
+// The RateLimit-* headers describe whichever limit is closest to being reached.
 func LimitPath(h fasthttp.RequestHandler) fasthttp.RequestHandler {
 	return func(ctx *fasthttp.RequestCtx) {
-		ip := utils.GetIP(ctx)
-		if global.Configuration.RateLimit.ResetAfter <= 0 {
+		config := global.Config()
+		if config.RateLimit.ResetAfter <= 0 || isHealthCheck(ctx) {
 			h(ctx)
-		} else {
-			p := string(ctx.Request.URI().Path())
-			pathType := constants.LimitGeneralPath
-			reqLimit := global.Configuration.RateLimit.Path.Global
+			return
+		}
+		client := security.IdentifyClient(ctx)
+		if client.Exempt {
+			h(ctx)
+			return
+		}
 
-			switch strings.ToLower(p) {
-			case "/upload":
-				pathType = constants.LimitUploadPath
-				reqLimit = global.Configuration.RateLimit.Path.Upload
-			}
-			if reqLimit <= 0 {
-				// skip rate limit check if no request limit/time was defined
-				h(ctx)
-			} else {
-				rlString := ""
-				// Check the global rate limit
-				isGlobalRateLimitOk, err := security.Try(ctx, global.RedisClient, fmt.Sprintf("G_%s", ip), int64(global.Configuration.RateLimit.Path.Global), int64(global.Configuration.RateLimit.ResetAfter), 1)
-				if err != nil {
-					response.SendJSONResponse(ctx, response.JSONResponse{
-						Status:  response.RequestStatusInternalError,
-						Data:    nil,
-						Message: fmt.Sprintf("Failed to call Try() to get information on global rate limit. %v", err),
-					}, fasthttp.StatusOK)
-					return
-				}
-				if !isGlobalRateLimitOk {
-					rlString = "Global path"
-				}
+		var results []security.Result
+		rlString := ""
 
-				if pathType != constants.LimitGeneralPath {
-					// Check the route exclusive rate limit
-					isPathOk, err := security.Try(ctx, global.RedisClient, fmt.Sprintf("%d_%s", pathType, ip), int64(reqLimit), int64(global.Configuration.RateLimit.ResetAfter), 1)
-					if err != nil {
-						response.SendJSONResponse(ctx, response.JSONResponse{
-							Status:  response.RequestStatusInternalError,
-							Data:    nil,
-							Message: fmt.Sprintf("Failed to call Try() to get information on path-specific rate limit. %v", err),
-						}, fasthttp.StatusOK)
-						return
-					}
+		// Check the global rate limit
+		globalLimit := config.RateLimit.Path.Global
+		if client.Authenticated && config.RateLimit.Path.GlobalAuthenticated > 0 {
+			globalLimit = config.RateLimit.Path.GlobalAuthenticated
+		}
+		if globalLimit > 0 {
+			globalResult, err := security.Try(ctx, fmt.Sprintf("G_%s", client.Key), int64(globalLimit), int64(config.RateLimit.ResetAfter), 1)
+			if err != nil {
+				response.SendJSONResponse(ctx, response.JSONResponse{
+					Status:  response.RequestStatusInternalError,
+					Data:    nil,
+					Message: fmt.Sprintf("Failed to call Try() to get information on global rate limit. %v", err),
+				}, fasthttp.StatusOK)
+				return
+			}
+			if !globalResult.Allowed {
+				rlString = "Global path"
+			}
+			results = append(results, globalResult)
+		}
 
-					if !isPathOk {
-						rlString = fmt.Sprintf("Path ID: %d", pathType)
-					}
-				}
-				if len(rlString) > 0 {
-					response.SendJSONResponse(ctx, response.JSONResponse{
-						Status:  response.RequestStatusInternalError,
-						Data:    nil,
-						Message: fmt.Sprintf("You are being rate limited. (%s)", rlString),
-					}, fasthttp.StatusTooManyRequests)
-					return
-				}
-				h(ctx)
+		// Check the rate limit of the route's policy
+		policy := security.MatchPolicy(config.RateLimit.Policies, string(ctx.Request.URI().Path()))
+		if policy != nil && security.PolicyLimit(policy, client) > 0 {
+			resetAfter := config.RateLimit.ResetAfter
+			if policy.ResetAfter > 0 {
+				resetAfter = policy.ResetAfter
 			}
+			policyResult, err := security.Try(ctx, fmt.Sprintf("P_%s_%s", policy.Route, client.Key), int64(security.PolicyLimit(policy, client)), int64(resetAfter), 1)
+			if err != nil {
+				response.SendJSONResponse(ctx, response.JSONResponse{
+					Status:  response.RequestStatusInternalError,
+					Data:    nil,
+					Message: fmt.Sprintf("Failed to call Try() to get information on path-specific rate limit. %v", err),
+				}, fasthttp.StatusOK)
+				return
+			}
+			if !policyResult.Allowed {
+				rlString = fmt.Sprintf("Route: %s", policy.Route)
+			}
+			results = append(results, policyResult)
+		}
+
+		if len(results) > 0 {
+			security.SetHeaders(ctx, security.MostRestrictive(results...))
+		}
+		if len(rlString) > 0 {
+			response.SendJSONResponse(ctx, response.JSONResponse{
+				Status:  response.RequestStatusError,
+				Data:    nil,
+				Message: fmt.Sprintf("You are being rate limited. (%s)", rlString),
+			}, fasthttp.StatusTooManyRequests)
+			return
+		}
+		h(ctx)
+	}
+}
+
+// isHealthCheck reports whether the request is for /healthz or /readyz, which aren't rate limited,
+// so health checks keep working no matter how busy the server is.
+func isHealthCheck(ctx *fasthttp.RequestCtx) bool {
+	p := string(ctx.Path())
+	return p == constants.HealthPath || p == constants.ReadyPath
+}
+
+// LogRequest gives every request an ID, which is returned in the X-Request-ID header,
+// and logs the request once it has been handled.
+func LogRequest(h fasthttp.RequestHandler) fasthttp.RequestHandler {
+	return func(ctx *fasthttp.RequestCtx) {
+		start := time.Now()
+		requestID, err := utils.RandomHex(8)
+		if err != nil {
+			requestID = strconv.FormatUint(ctx.ID(), 10)
 		}
+		ctx.SetUserValue(constants.UserValueRequestID, requestID)
+		ctx.Response.Header.Set(constants.RequestIDHeader, requestID)
+		method := string(ctx.Method())
+		route := utils.PathForLog(ctx.RequestURI())
+
+		h(ctx)
+
+		fields := logger.RequestFields(ctx, logger.Fields{
+			"method":   method,
+			"status":   ctx.Response.StatusCode(),
+			"duration": time.Since(start).Milliseconds(),
+			"bytes":    len(ctx.Response.Body()),
+		})
+		// the route may have been rewritten by a handler (zero-width paths), log what the client asked for
+		fields["route"] = route
+		logger.Info("Request handled", fields)
 	}
 }
 
@@ -85,6 +135,9 @@ func HandleCORS(h fasthttp.RequestHandler) fasthttp.RequestHandler {
 		ctx.Response.Header.Set("Access-Control-Allow-Origin", "*")
 		ctx.Response.Header.Set("Access-Control-Allow-Methods", "OPTIONS,POST,GET")
 		ctx.Response.Header.Set("Access-Control-Allow-Headers", "Authorization")
+		ctx.Response.Header.Set("Access-Control-Expose-Headers", strings.Join([]string{constants.RequestIDHeader,
+			constants.RateLimitLimitHeader, constants.RateLimitRemainingHeader, constants.RateLimitResetHeader,
+			constants.RetryAfterHeader}, ", "))
 		if ctx.Request.Header.IsOptions() {
 			ctx.SetStatusCode(fasthttp.StatusOK)
 			return
@@ -109,6 +162,12 @@ func HandleHTTPRequest(ctx *fasthttp.RequestCtx) {
 	case "/stats":
 		routes.ServeStats(ctx)
 		break
+	case constants.HealthPath:
+		routes.ServeHealth(ctx)
+		break
+	case constants.ReadyPath:
+		routes.ServeReady(ctx)
+		break
 	default:
 		if !ctx.IsGet() {
 			ctx.SetStatusCode(fasthttp.StatusBadRequest)
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"tytanium/constants"
+	"tytanium/utils"
+)
+
+// migrateCommand moves the stored files to the layout given with -to (Storage.Layout by default). Files are looked up
+// in both layouts, so a server using the layout files are moved to keeps serving them while it runs.
+func migrateCommand(args []string) int {
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	to := fs.String("to", "", "the layout to move files to, flat or sharded (default is Storage.Layout)")
+	dryRun := fs.Bool("dry-run", false, "only print what would be moved")
+	c, code := loadCommandConfiguration(fs, args)
+	if c == nil {
+		return code
+	}
+	layout := *to
+	if len(layout) == 0 {
+		layout = c.Storage.Layout
+	}
+	if layout != utils.LayoutFlat && layout != utils.LayoutSharded {
+		fmt.Fprintf(os.Stderr, "-to must be %s or %s, got %q\n", utils.LayoutFlat, utils.LayoutSharded, layout)
+		return 2
+	}
+	if layout == utils.LayoutSharded && c.Storage.ShardLength < 1 {
+		fmt.Fprintf(os.Stderr, "Storage.ShardLength must be at least 1, got %d\n", c.Storage.ShardLength)
+		return 2
+	}
+
+	root := c.Storage.Directory
+	dirs := []string{root}
+	entries, err := ioutil.ReadDir(root)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to read %s, %v\n", root, err)
+		return 1
+	}
+	// only directories that look like shards are moved out of, as anything else wasn't put there by the server
+	for _, e := range entries {
+		if e.IsDir() && utils.IsShard(e.Name(), c.Storage.ShardLength) {
+			dirs = append(dirs, filepath.Join(root, e.Name()))
+		}
+	}
+
+	var moved, skipped int
+	for _, dir := range dirs {
+		files, err := ioutil.ReadDir(dir)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to read %s, %v\n", dir, err)
+			return 1
+		}
+		for _, f := range files {
+			// temp files belong to uploads in progress, which finish in the directory they started in
+			if !f.Mode().IsRegular() || strings.HasPrefix(f.Name(), constants.TempFilePrefix) {
+				continue
+			}
+			destDir := utils.LayoutDir(root, layout, c.Storage.ShardLength, f.Name())
+			if destDir == dir {
+				continue
+			}
+			src, dest := filepath.Join(dir, f.Name()), filepath.Join(destDir, f.Name())
+			if *dryRun {
+				if _, err := os.Lstat(dest); err == nil {
+					fmt.Fprintf(os.Stderr, "Would skip %s, %s already exists\n", src, dest)
+					skipped++
+					continue
+				}
+				fmt.Printf("Would move %s to %s\n", src, dest)
+				moved++
+				continue
+			}
+			if err := os.MkdirAll(destDir, 0755); err != nil {
+				fmt.Fprintf(os.Stderr, "Failed to create %s, %v\n", destDir, err)
+				return 1
+			}
+			// the file is linked and then removed instead of renamed, as a link never replaces a file that's already
+			// there, and the file can always be found in one of the two places
+			if err := os.Link(src, dest); os.IsExist(err) {
+				fmt.Fprintf(os.Stderr, "Skipping %s, %s already exists\n", src, dest)
+				skipped++
+				continue
+			} else if err != nil {
+				fmt.Fprintf(os.Stderr, "Failed to move %s to %s, %v (the filesystem must support hard links)\n", src, dest, err)
+				return 1
+			}
+			if err := os.Remove(src); err != nil {
+				fmt.Fprintf(os.Stderr, "Failed to remove %s after linking it to %s, %v\n", src, dest, err)
+				return 1
+			}
+			moved++
+		}
+		if dir != root && layout == utils.LayoutFlat && !*dryRun {
+			// fails if anything is left in the shard, which is fine
+			_ = os.Remove(dir)
+		}
+	}
+
+	verb := "Moved"
+	if *dryRun {
+		verb = "Would move"
+	}
+	fmt.Printf("%s %d file(s) to the %s layout.\n", verb, moved, layout)
+	if skipped > 0 {
+		fmt.Printf("Skipped %d file(s) that already exist in the %s layout.\n", skipped, layout)
+		return 1
+	}
+	return 0
+}
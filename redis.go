@@ -0,0 +1,122 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"github.com/go-redis/redis/v8"
+	"io/ioutil"
+	"strings"
+	"time"
+	"tytanium/api"
+)
+
+// isRedisURL reports whether uri is a URL like redis://localhost:6379/0 rather than a plain host:port.
+func isRedisURL(uri string) bool {
+	return strings.Contains(uri, "://")
+}
+
+// redisOptions builds the client options from the Redis section of the configuration.
+// A URL in Redis.URI gives the address, and the username, password, database and TLS if it has them.
+// Redis.Addresses, if set, replaces the address from Redis.URI.
+func redisOptions(c *api.Configuration) (*redis.UniversalOptions, error) {
+	r := c.Redis
+	o := &redis.UniversalOptions{
+		Addrs:            []string{r.URI},
+		Username:         r.Username,
+		Password:         r.Password,
+		DB:               r.DB,
+		MasterName:       r.MasterName,
+		SentinelUsername: r.SentinelUsername,
+		SentinelPassword: r.SentinelPassword,
+		PoolSize:         r.PoolSize,
+		MinIdleConns:     r.MinIdleConns,
+		MaxRetries:       r.MaxRetries,
+		DialTimeout:      time.Duration(r.DialTimeout) * time.Millisecond,
+		ReadTimeout:      time.Duration(r.ReadTimeout) * time.Millisecond,
+		WriteTimeout:     time.Duration(r.WriteTimeout) * time.Millisecond,
+		PoolTimeout:      time.Duration(r.PoolTimeout) * time.Millisecond,
+	}
+
+	if isRedisURL(r.URI) {
+		u, err := redis.ParseURL(r.URI)
+		if err != nil {
+			return nil, err
+		}
+		o.Addrs = []string{u.Addr}
+		if len(u.Username) > 0 {
+			o.Username = u.Username
+		}
+		if len(u.Password) > 0 {
+			o.Password = u.Password
+		}
+		if u.DB != 0 {
+			o.DB = u.DB
+		}
+		// rediss://
+		o.TLSConfig = u.TLSConfig
+	}
+	if len(r.Addresses) > 0 {
+		o.Addrs = r.Addresses
+	}
+
+	if r.TLS.Enabled {
+		t, err := redisTLSConfig(c)
+		if err != nil {
+			return nil, err
+		}
+		if len(t.ServerName) == 0 && o.TLSConfig != nil {
+			t.ServerName = o.TLSConfig.ServerName
+		}
+		o.TLSConfig = t
+	}
+	return o, nil
+}
+
+// redisTLSConfig builds the TLS configuration from Redis.TLS. The system's CAs are trusted unless Redis.TLS.CAFile is set,
+// and a client certificate is only sent if Redis.TLS.CertFile and Redis.TLS.KeyFile are set.
+func redisTLSConfig(c *api.Configuration) (*tls.Config, error) {
+	r := c.Redis.TLS
+	t := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		ServerName:         r.ServerName,
+		InsecureSkipVerify: r.InsecureSkipVerify,
+	}
+	if len(r.CAFile) > 0 {
+		pem, err := ioutil.ReadFile(r.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read Redis.TLS.CAFile, %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in Redis.TLS.CAFile %s", r.CAFile)
+		}
+		t.RootCAs = pool
+	}
+	if len(r.CertFile) > 0 {
+		cert, err := tls.LoadX509KeyPair(r.CertFile, r.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("cannot load the Redis client certificate, %v", err)
+		}
+		t.Certificates = []tls.Certificate{cert}
+	}
+	return t, nil
+}
+
+// newRedisClient connects to Redis as set in the configuration: a single server, a Cluster if Redis.Cluster is true,
+// or the master of Redis.MasterName found through the Sentinels in Redis.Addresses.
+func newRedisClient(c *api.Configuration) (redis.UniversalClient, error) {
+	o, err := redisOptions(c)
+	if err != nil {
+		return nil, err
+	}
+	// NewUniversalClient isn't used, as it picks the kind of client from the number of addresses
+	switch {
+	case c.Redis.Cluster:
+		return redis.NewClusterClient(o.Cluster()), nil
+	case len(c.Redis.MasterName) > 0:
+		return redis.NewFailoverClient(o.Failover()), nil
+	default:
+		return redis.NewClient(o.Simple()), nil
+	}
+}
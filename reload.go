@@ -0,0 +1,157 @@
+package main
+
+import (
+	"github.com/fsnotify/fsnotify"
+	"github.com/spf13/viper"
+	"log"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"tytanium/api"
+	"tytanium/global"
+	"tytanium/logger"
+)
+
+// reloadMu makes sure only one reload runs at a time, whether it was started by SIGHUP or the file watcher.
+var reloadMu sync.Mutex
+
+// reloadConfiguration reads the configuration file again and, if it's valid, publishes it as the current configuration.
+// If it isn't valid, the current configuration is kept and the error is returned.
+// Settings which can't change while the server is running are carried over from the current configuration.
+func reloadConfiguration() error {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+
+	c, err := loadConfiguration()
+	if err != nil {
+		log.Printf("Configuration reload rejected, keeping the current configuration: %v", err)
+		logger.Error("Configuration reload rejected", logger.Fields{"error": err})
+		return err
+	}
+
+	keepStaticSettings(c, global.Config())
+	global.SetConfig(c)
+
+	// both were checked by validateConfiguration
+	level, _ := logger.ParseLevel(c.Logging.Level)
+	format, _ := logger.ParseFormat(c.Logging.Format)
+	logger.Configure(level, format)
+
+	log.Println("Configuration reloaded")
+	logger.Info("Configuration reloaded", nil)
+	return nil
+}
+
+// keepStaticSettings copies the settings that are only read on startup from old to c.
+// A warning is logged for each one that was changed, as a restart is needed to apply them.
+func keepStaticSettings(c *api.Configuration, old *api.Configuration) {
+	keep := func(name string, newValue interface{}, oldValue interface{}) bool {
+		if reflect.DeepEqual(newValue, oldValue) {
+			return false
+		}
+		log.Printf("Warning: %s can't be changed without a restart, ignoring the new value", name)
+		logger.Warn("Setting can't be changed without a restart", logger.Fields{"setting": name})
+		return true
+	}
+
+	if keep("Server", c.Server, old.Server) {
+		c.Server = old.Server
+	}
+	if keep("Redis", c.Redis, old.Redis) {
+		c.Redis = old.Redis
+	}
+	if keep("Store", c.Store, old.Store) {
+		c.Store = old.Store
+	}
+	if keep("RateLimit.Backend", c.RateLimit.Backend, old.RateLimit.Backend) {
+		c.RateLimit.Backend = old.RateLimit.Backend
+	}
+	if keep("Storage.Directory", c.Storage.Directory, old.Storage.Directory) {
+		c.Storage.Directory = old.Storage.Directory
+	}
+	// both make up the length of links, so lowering them would break the links given out before
+	if keep("Storage.IDLength", c.Storage.IDLength, old.Storage.IDLength) {
+		c.Storage.IDLength = old.Storage.IDLength
+	}
+	if keep("Encryption.EncryptionKeyLength", c.Encryption.EncryptionKeyLength, old.Encryption.EncryptionKeyLength) {
+		c.Encryption.EncryptionKeyLength = old.Encryption.EncryptionKeyLength
+	}
+	if keep("Storage.MaxSize", c.Storage.MaxSize, old.Storage.MaxSize) {
+		c.Storage.MaxSize = old.Storage.MaxSize
+	}
+	// uploads reserve their ID in the directory of the layout, so it can't change under them
+	if keep("Storage.Layout", c.Storage.Layout, old.Storage.Layout) {
+		c.Storage.Layout = old.Storage.Layout
+	}
+	if keep("Storage.ShardLength", c.Storage.ShardLength, old.Storage.ShardLength) {
+		c.Storage.ShardLength = old.Storage.ShardLength
+	}
+	if keep("Encryption.Nonce", c.Encryption.Nonce, old.Encryption.Nonce) {
+		c.Encryption.Nonce = old.Encryption.Nonce
+	}
+	if keep("Logging.Enabled", c.Logging.Enabled, old.Logging.Enabled) {
+		c.Logging.Enabled = old.Logging.Enabled
+	}
+	if keep("Logging.LogFile", c.Logging.LogFile, old.Logging.LogFile) {
+		c.Logging.LogFile = old.Logging.LogFile
+	}
+	if keep("Logging.AccessLog.Enabled", c.Logging.AccessLog.Enabled, old.Logging.AccessLog.Enabled) {
+		c.Logging.AccessLog.Enabled = old.Logging.AccessLog.Enabled
+	}
+	if keep("Logging.AccessLog.File", c.Logging.AccessLog.File, old.Logging.AccessLog.File) {
+		c.Logging.AccessLog.File = old.Logging.AccessLog.File
+	}
+	if keep("Logging.Rotation", c.Logging.Rotation, old.Logging.Rotation) {
+		c.Logging.Rotation = old.Logging.Rotation
+	}
+	if keep("WatchConfig", c.WatchConfig, old.WatchConfig) {
+		c.WatchConfig = old.WatchConfig
+	}
+	c.PathLengthLimitBytes = pathLengthLimit(c)
+}
+
+// watchConfiguration reloads the configuration whenever the configuration file changes. viper.WatchConfig isn't used,
+// as it reads the file on its own goroutine, which would race with reloads started by SIGHUP.
+func watchConfiguration() {
+	file := viper.ConfigFileUsed()
+	if len(file) == 0 {
+		log.Println("[init] Warning: WatchConfig is set, but no configuration file is used")
+		return
+	}
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		log.Printf("[init] Warning: failed to watch the configuration file, %v", err)
+		return
+	}
+	// the directory is watched, as editors and Kubernetes replace the file instead of writing to it
+	if err := w.Add(filepath.Dir(file)); err != nil {
+		_ = w.Close()
+		log.Printf("[init] Warning: failed to watch the configuration file, %v", err)
+		return
+	}
+
+	file = filepath.Clean(file)
+	realFile, _ := filepath.EvalSymlinks(file)
+	go func() {
+		for {
+			select {
+			case e, ok := <-w.Events:
+				if !ok {
+					return
+				}
+				currentFile, _ := filepath.EvalSymlinks(file)
+				written := filepath.Clean(e.Name) == file && e.Op&(fsnotify.Write|fsnotify.Create) != 0
+				if written || (len(currentFile) > 0 && currentFile != realFile) {
+					realFile = currentFile
+					_ = reloadConfiguration()
+				}
+			case err, ok := <-w.Errors:
+				if !ok {
+					return
+				}
+				log.Printf("Error watching the configuration file, %v", err)
+			}
+		}
+	}()
+	log.Println("[init] Watching the configuration file for changes")
+}
@@ -5,7 +5,6 @@ import (
 	"fmt"
 	"github.com/valyala/fasthttp"
 	"log"
-	"tytanium/global"
 	"tytanium/logger"
 )
 
@@ -50,20 +49,16 @@ type JSONResponse struct {
 
 // SendJSONResponse sends a JSON encoded response to the client along with an HTTP status code of 200 OK.
 func SendJSONResponse(ctx *fasthttp.RequestCtx, j JSONResponse, statusCode int) {
-	if statusCode == RequestStatusInternalError {
+	if j.Status == RequestStatusInternalError {
 		log.Printf(fmt.Sprintf("Unhandled error!, %s", j.Message))
-		if global.Configuration.Logging.Enabled {
-			logger.ErrorLogger.Printf("500 response sent; error message: %v", j.Message)
-		}
+		logger.Error("Internal error response sent", logger.RequestFields(ctx, logger.Fields{"error": j.Message}))
 	}
 
 	ctx.SetContentType(jsonContentType)
 	ctx.SetStatusCode(statusCode)
 	e := json2.NewEncoder(ctx.Response.BodyWriter()).Encode(j)
 	if e != nil {
-		if global.Configuration.Logging.Enabled {
-			logger.ErrorLogger.Printf("Failed to send JSON response; error message: %v", e)
-		}
+		logger.Error("Failed to send JSON response", logger.RequestFields(ctx, logger.Fields{"error": e}))
 		log.Printf(fmt.Sprintf("JSON failed to send! %v", e))
 	}
 }
@@ -0,0 +1,56 @@
+package routes
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+)
+
+// fileHeaderMagic starts the files stored by their ID. It's followed by the length of the extension the file was
+// uploaded with and the extension itself, so the file is only served with that extension. Files stored before that
+// start with the encrypted data right away, whose first byte is the version of the format (0x10 or 0x20), so they
+// can't be mistaken for having a header.
+var fileHeaderMagic = []byte("TY")
+
+// errInvalidFileHeader is returned by readFileHeader if the header is cut short.
+var errInvalidFileHeader = errors.New("the file header is invalid")
+
+// fileHeaderSize returns the size of the header written by writeFileHeader for ext.
+func fileHeaderSize(ext string) int64 {
+	return int64(len(fileHeaderMagic) + 1 + len(ext))
+}
+
+// writeFileHeader writes the header of a file uploaded with ext to w. ext can't be longer than
+// constants.ExtensionLengthLimit, so its length fits in a byte.
+func writeFileHeader(w io.Writer, ext string) error {
+	header := make([]byte, 0, fileHeaderSize(ext))
+	header = append(header, fileHeaderMagic...)
+	header = append(header, byte(len(ext)))
+	header = append(header, ext...)
+	_, err := w.Write(header)
+	return err
+}
+
+// readFileHeader reads the header at the start of f, and returns the extension in it and where the encrypted data
+// starts. Files without a header have no extension, and their data starts at 0. f is left at the start of the data.
+func readFileHeader(f *os.File) (string, int64, error) {
+	prefix := make([]byte, len(fileHeaderMagic)+1)
+	n, err := io.ReadFull(f, prefix)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", 0, err
+	}
+	if n < len(fileHeaderMagic) || !bytes.Equal(prefix[:len(fileHeaderMagic)], fileHeaderMagic) {
+		_, err := f.Seek(0, io.SeekStart)
+		return "", 0, err
+	}
+	if n < len(prefix) {
+		return "", 0, errInvalidFileHeader
+	}
+
+	ext := make([]byte, prefix[len(fileHeaderMagic)])
+	if _, err := io.ReadFull(f, ext); err != nil {
+		return "", 0, errInvalidFileHeader
+	}
+	return string(ext), fileHeaderSize(string(ext)), nil
+}
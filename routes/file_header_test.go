@@ -0,0 +1,63 @@
+package routes
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReadFileHeader(t *testing.T) {
+	withHeader := func(ext string, data string) []byte {
+		var b bytes.Buffer
+		if err := writeFileHeader(&b, ext); err != nil {
+			t.Fatal(err)
+		}
+		return append(b.Bytes(), data...)
+	}
+
+	tests := []struct {
+		name     string
+		content  []byte
+		wantExt  string
+		wantData string
+		wantErr  bool
+	}{
+		{"with an extension", withHeader(".png", "\x20data"), ".png", "\x20data", false},
+		{"without an extension", withHeader("", "\x20data"), "", "\x20data", false},
+		{"stored before headers", []byte("\x20data"), "", "\x20data", false},
+		{"shorter than the magic", []byte("T"), "", "T", false},
+		{"empty", nil, "", "", false},
+		{"cut off after the magic", []byte("TY"), "", "", true},
+		{"cut off in the extension", []byte("TY\x04.pn"), "", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := filepath.Join(t.TempDir(), "file")
+			if err := os.WriteFile(p, tt.content, 0600); err != nil {
+				t.Fatal(err)
+			}
+			f, err := os.Open(p)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+
+			ext, start, err := readFileHeader(f)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("readFileHeader() error = %v, want error %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			data, err := io.ReadAll(f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ext != tt.wantExt || string(data) != tt.wantData || start != int64(len(tt.content)-len(tt.wantData)) {
+				t.Errorf("readFileHeader() = %q, %d and data %q, want %q and data %q", ext, start, data, tt.wantExt, tt.wantData)
+			}
+		})
+	}
+}
@@ -5,7 +5,6 @@ import (
 	_ "embed"
 	"github.com/valyala/fasthttp"
 	"io"
-	"tytanium/global"
 	"tytanium/logger"
 )
 
@@ -22,9 +21,7 @@ func ServeFavicon(ctx *fasthttp.RequestCtx) {
 	ctx.Response.Header.Set("Content-Type", FaviconContentType)
 	_, e := io.Copy(ctx.Response.BodyWriter(), b)
 	if e != nil {
-		if global.Configuration.Logging.Enabled {
-			logger.ErrorLogger.Printf("Failed to send favicon: %v", e)
-		}
+		logger.Error("Failed to send favicon", logger.RequestFields(ctx, logger.Fields{"error": e}))
 		ctx.Response.SetStatusCode(fasthttp.StatusInternalServerError)
 	}
 }
@@ -47,7 +47,8 @@ var (
 // ServeFile will serve the / endpoint. It gets the "id" variable from mux and tries to find the file's information in the database.
 // If an ID is either not provided or not found, the function hands the request off to ServeNotFound.
 func ServeFile(ctx *fasthttp.RequestCtx) {
-	if len(ctx.Request.RequestURI()) > constants.PathLengthLimitBytes {
+	config := global.Config()
+	if len(ctx.Request.RequestURI()) > config.PathLengthLimitBytes {
 		response.SendJSONResponse(ctx, response.JSONResponse{
 			Status:  response.RequestStatusError,
 			Data:    nil,
@@ -99,10 +100,30 @@ func ServeFile(ctx *fasthttp.RequestCtx) {
 	}
 
 	pathNoLeadingSlash := string(ctx.Request.URI().Path()[1:])
-	filePath := path.Join(global.Configuration.Storage.Directory, pathNoLeadingSlash)
+	// files are only served by their name, not by their path in the storage directory, and never by the name of
+	// a temp file that's still being written
+	if strings.Contains(pathNoLeadingSlash, "/") || strings.HasPrefix(pathNoLeadingSlash, ".") {
+		ServeNotFound(ctx)
+		return
+	}
 
-	// we only need to know if it exists or not
-	fileInfo, err := os.Stat(filePath)
+	// we only need to know if it exists or not. It's looked for in both layouts, as it may not have been migrated yet.
+	// Files are stored by their ID, except those stored before that, which are named with their extension.
+	// Those are looked for first, as the header of a file stored by its ID is only read once it's found.
+	var filePath string
+	var fileInfo os.FileInfo
+	var err error
+	fileId := strings.TrimSuffix(pathNoLeadingSlash, path.Ext(pathNoLeadingSlash))
+lookup:
+	for _, name := range []string{pathNoLeadingSlash, fileId} {
+		for _, dir := range utils.FileDirs(pathNoLeadingSlash) {
+			filePath = path.Join(dir, name)
+			fileInfo, err = os.Stat(filePath)
+			if !os.IsNotExist(err) {
+				break lookup
+			}
+		}
+	}
 	if err != nil {
 		if os.IsNotExist(err) {
 			ServeNotFound(ctx)
@@ -121,8 +142,41 @@ func ServeFile(ctx *fasthttp.RequestCtx) {
 		return
 	}
 
-	if global.Configuration.RateLimit.Bandwidth.Download > 0 && global.Configuration.RateLimit.Bandwidth.ResetAfter > 0 {
-		isBandwidthLimitNotReached, err := security.Try(ctx, global.RedisClient, fmt.Sprintf("%s_%s", constants.RateLimitBandwidthDownload, utils.GetIP(ctx)), int64(global.Configuration.RateLimit.Bandwidth.Download), int64(global.Configuration.RateLimit.Bandwidth.ResetAfter), fileInfo.Size())
+	// We don't need a limited reader because mimetype.DetectReader automatically caps it
+	fileReader, e := os.OpenFile(filePath, os.O_RDONLY, 0644)
+	if e != nil {
+		response.SendJSONResponse(ctx, response.JSONResponse{
+			Status:  response.RequestStatusInternalError,
+			Data:    nil,
+			Message: fmt.Sprintf("The file could not be opened. %v", err),
+		}, fasthttp.StatusOK)
+		return
+	}
+	defer func() {
+		_ = fileReader.Close()
+	}()
+
+	// files stored by their ID are only served with the extension they were uploaded with
+	var dataStart int64
+	if path.Base(filePath) == fileId {
+		var ext string
+		ext, dataStart, err = readFileHeader(fileReader)
+		if err != nil {
+			response.SendJSONResponse(ctx, response.JSONResponse{
+				Status:  response.RequestStatusInternalError,
+				Data:    nil,
+				Message: fmt.Sprintf("The file header could not be read. %v", err),
+			}, fasthttp.StatusOK)
+			return
+		}
+		if fileId+ext != pathNoLeadingSlash {
+			ServeNotFound(ctx)
+			return
+		}
+	}
+
+	if client := security.IdentifyClient(ctx); !client.Exempt && config.RateLimit.Bandwidth.Download > 0 && config.RateLimit.Bandwidth.ResetAfter > 0 {
+		bandwidthResult, err := security.Try(ctx, fmt.Sprintf("%s_%s", constants.RateLimitBandwidthDownload, client.Key), int64(config.RateLimit.Bandwidth.Download), int64(config.RateLimit.Bandwidth.ResetAfter), fileInfo.Size())
 		if err != nil {
 			response.SendJSONResponse(ctx, response.JSONResponse{
 				Status:  response.RequestStatusInternalError,
@@ -131,7 +185,9 @@ func ServeFile(ctx *fasthttp.RequestCtx) {
 			}, fasthttp.StatusOK)
 			return
 		}
-		if !isBandwidthLimitNotReached {
+		if !bandwidthResult.Allowed {
+			// the bandwidth limit is what the client has to wait for now, so it replaces the request limit's headers
+			security.SetHeaders(ctx, bandwidthResult)
 			response.SendJSONResponse(ctx, response.JSONResponse{
 				Status:  response.RequestStatusError,
 				Data:    nil,
@@ -141,21 +197,7 @@ func ServeFile(ctx *fasthttp.RequestCtx) {
 		}
 	}
 
-	// We don't need a limited reader because mimetype.DetectReader automatically caps it
-	fileReader, e := os.OpenFile(filePath, os.O_RDONLY, 0644)
-	if e != nil {
-		response.SendJSONResponse(ctx, response.JSONResponse{
-			Status:  response.RequestStatusInternalError,
-			Data:    nil,
-			Message: fmt.Sprintf("The file could not be opened. %v", err),
-		}, fasthttp.StatusOK)
-		return
-	}
-	defer func() {
-		_ = fileReader.Close()
-	}()
-
-	key, err := encryption.DeriveKey(ctx.QueryArgs().Peek(paramEncryptionKey), []byte(global.Configuration.Encryption.Nonce))
+	key, err := encryption.DeriveKey(ctx.QueryArgs().Peek(paramEncryptionKey), []byte(config.Encryption.Nonce))
 	if err != nil {
 		response.SendJSONResponse(ctx, response.JSONResponse{
 			Status:  response.RequestStatusInternalError,
@@ -201,18 +243,18 @@ func ServeFile(ctx *fasthttp.RequestCtx) {
 			ctx.Response.Header.Add("Pragma", "no-cache")
 			ctx.Response.Header.Add("Expires", "0")
 
-			u := fmt.Sprintf("%s/%s?%s=true&enc_key=%s", global.Configuration.Domain, pathNoLeadingSlash, paramRaw, string(ctx.QueryArgs().Peek(paramEncryptionKey)))
+			u := fmt.Sprintf("%s/%s?%s=true&enc_key=%s", config.Domain, pathNoLeadingSlash, paramRaw, string(ctx.QueryArgs().Peek(paramEncryptionKey)))
 			_, _ = fmt.Fprint(ctx.Response.BodyWriter(), strings.Replace(discordHTML, "{{.}}", u, 1))
 			return
 		}
 	}
 
-	_, err = fileReader.Seek(0, io.SeekStart)
+	_, err = fileReader.Seek(dataStart, io.SeekStart)
 	if err != nil {
 		response.SendJSONResponse(ctx, response.JSONResponse{
 			Status:  response.RequestStatusInternalError,
 			Data:    nil,
-			Message: fmt.Sprintf("Failed to reset file reader to 0. %v", err),
+			Message: fmt.Sprintf("Failed to reset file reader to the start of the data. %v", err),
 		}, fasthttp.StatusOK)
 		return
 	}
@@ -227,5 +269,7 @@ func ServeFile(ctx *fasthttp.RequestCtx) {
 			Data:    nil,
 			Message: fmt.Sprintf("Failed to write decrypted file to the response body. %v", err),
 		}, fasthttp.StatusOK)
+		return
 	}
+	recordTraffic(ctx, false, fileInfo.Size())
 }
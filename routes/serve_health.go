@@ -0,0 +1,125 @@
+package routes
+
+import (
+	"context"
+	"github.com/valyala/fasthttp"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+	"tytanium/constants"
+	"tytanium/global"
+	"tytanium/logger"
+	"tytanium/response"
+	"tytanium/store"
+)
+
+const (
+	// readyCheckTimeout is how long pinging Redis or the store may take during a readiness check.
+	readyCheckTimeout = 2 * time.Second
+	// readyCacheTime is how long the result of the readiness checks is reused. /readyz isn't rate limited, and every
+	// check writes a file, so it would otherwise let anyone write to the disk as often as they like.
+	readyCacheTime = time.Second
+)
+
+const (
+	// checkOK is the result of a readiness check that passed.
+	checkOK = "ok"
+	// checkFail is the result of a readiness check that failed. Why it failed is only logged, as /readyz is public.
+	checkFail = "fail"
+)
+
+// lastReadyCheck is the result of the last readiness checks. The lock is held while they run, so they run once
+// for every request waiting for them.
+var lastReadyCheck = struct {
+	sync.Mutex
+	at    time.Time
+	stats ReadyStats
+	ready bool
+}{}
+
+// HealthStats are returned by /healthz.
+type HealthStats struct {
+	Uptime int64 `json:"uptime"`
+}
+
+// ReadyStats are returned by /readyz, with the result of each check: "ok" or "fail".
+type ReadyStats struct {
+	Checks map[string]string `json:"checks"`
+}
+
+// ServeHealth tells whether the server is running, which it is if it can answer at all.
+func ServeHealth(ctx *fasthttp.RequestCtx) {
+	response.SendJSONResponse(ctx, response.JSONResponse{
+		Status:  response.RequestStatusOK,
+		Data:    &HealthStats{Uptime: int64(time.Since(global.StartTime) / time.Second)},
+		Message: "",
+	}, fasthttp.StatusOK)
+}
+
+// ServeReady tells whether the server can handle requests: Redis and the store can be reached, files can be written
+// to Storage.Directory and it has at least Storage.MinFreeSpace bytes and Storage.MinFreePercent percent free.
+// If any of them fail, HTTP status code 503 is returned.
+func ServeReady(ctx *fasthttp.RequestCtx) {
+	lastReadyCheck.Lock()
+	if time.Since(lastReadyCheck.at) >= readyCacheTime {
+		lastReadyCheck.stats, lastReadyCheck.ready = runReadyChecks()
+		lastReadyCheck.at = time.Now()
+	}
+	stats, ready := lastReadyCheck.stats, lastReadyCheck.ready
+	lastReadyCheck.Unlock()
+
+	if !ready {
+		response.SendJSONResponse(ctx, response.JSONResponse{
+			Status:  response.RequestStatusError,
+			Data:    &stats,
+			Message: "The server is not ready.",
+		}, fasthttp.StatusServiceUnavailable)
+		return
+	}
+	response.SendJSONResponse(ctx, response.JSONResponse{
+		Status:  response.RequestStatusOK,
+		Data:    &stats,
+		Message: "",
+	}, fasthttp.StatusOK)
+}
+
+// runReadyChecks runs the checks of ServeReady, and returns their results and whether all of them passed.
+func runReadyChecks() (ReadyStats, bool) {
+	config := global.Config()
+	stats := ReadyStats{Checks: make(map[string]string)}
+	ready := true
+	check := func(name string, err error) {
+		if err != nil {
+			logger.Warn("Readiness check failed", logger.Fields{"check": name, "error": err})
+			stats.Checks[name] = checkFail
+			ready = false
+			return
+		}
+		stats.Checks[name] = checkOK
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), readyCheckTimeout)
+	defer cancel()
+	if global.RedisClient != nil {
+		check("redis", global.RedisClient.Ping(ctx).Err())
+	}
+	if config.Store.Type != store.TypeRedis {
+		check("store", global.Store.Ping(ctx))
+	}
+	check("storage", checkWritable(config.Storage.Directory))
+	if config.Storage.MinFreeSpace > 0 || config.Storage.MinFreePercent > 0 {
+		check("disk", checkDiskSpace(config.Storage.Directory, 0))
+	}
+	return stats, ready
+}
+
+// checkWritable creates and removes a file in dir.
+func checkWritable(dir string) error {
+	f, err := ioutil.TempFile(dir, constants.TempFilePrefix+"readyz-")
+	if err != nil {
+		return err
+	}
+	_ = f.Close()
+	return os.Remove(f.Name())
+}
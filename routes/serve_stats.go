@@ -2,10 +2,9 @@ package routes
 
 import (
 	"fmt"
-	"github.com/go-redis/redis/v8"
 	"github.com/valyala/fasthttp"
 	"runtime"
-	"strconv"
+	"time"
 	"tytanium/constants"
 	"tytanium/global"
 	"tytanium/response"
@@ -16,6 +15,28 @@ type GeneralStats struct {
 	ServerVersion  string               `json:"server_version"`
 	RuntimeVersion string               `json:"runtime_version,omitempty"`
 	SizeStats      StatsFromSizeChecker `json:"size_stats"`
+	RuntimeStats   *RuntimeStats        `json:"runtime_stats,omitempty"`
+	TrafficStats   *TrafficStats        `json:"traffic_stats,omitempty"`
+}
+
+// RuntimeStats represent the process stats returned by /stats if MoreStats is enabled.
+type RuntimeStats struct {
+	Uptime            int64       `json:"uptime"`
+	Goroutines        int         `json:"goroutines"`
+	ActiveConnections int32       `json:"active_connections"`
+	Memory            MemoryStats `json:"memory"`
+}
+
+// MemoryStats represent a subset of runtime.MemStats. All sizes are in bytes.
+type MemoryStats struct {
+	Alloc        uint64 `json:"alloc"`
+	TotalAlloc   uint64 `json:"total_alloc"`
+	Sys          uint64 `json:"sys"`
+	HeapInuse    uint64 `json:"heap_inuse"`
+	HeapObjects  uint64 `json:"heap_objects"`
+	NumGC        uint32 `json:"num_gc"`
+	LastGC       int64  `json:"last_gc"`
+	PauseTotalNs uint64 `json:"pause_total_ns"`
 }
 
 // StatsFromSizeChecker represent all stats returned by an external size checker program.
@@ -26,57 +47,70 @@ type StatsFromSizeChecker struct {
 	LastUpdated    int64 `json:"last_updated"`
 }
 
-// ServeStats serves stats. StatsFromSizeChecker are populated into redis by https://github.com/vysiondev/size-checker.
+// ServeStats serves stats. StatsFromSizeChecker are saved to the store by "tytanium stats -save", or to Redis by
+// https://github.com/vysiondev/size-checker.
 func ServeStats(ctx *fasthttp.RequestCtx) {
 	var stats GeneralStats
 	stats.ServerVersion = constants.Version
 
-	totalSize, err := getStatValueFromRedis(ctx, global.RedisClient, "sc_total_size")
+	totalSize, err := global.Store.Get(ctx, "sc_total_size")
 	if err != nil {
 		response.SendJSONResponse(ctx, response.JSONResponse{
 			Status:  response.RequestStatusInternalError,
 			Data:    nil,
-			Message: fmt.Sprintf("An error occurred while trying to get sc_total_size from Redis: %v", err),
+			Message: fmt.Sprintf("An error occurred while trying to get sc_total_size from the store: %v", err),
 		}, fasthttp.StatusOK)
 		return
 	}
 	stats.SizeStats.TotalSize = totalSize
 
-	fileCount, err := getStatValueFromRedis(ctx, global.RedisClient, "sc_file_count")
+	fileCount, err := global.Store.Get(ctx, "sc_file_count")
 	if err != nil {
 		response.SendJSONResponse(ctx, response.JSONResponse{
 			Status:  response.RequestStatusInternalError,
 			Data:    nil,
-			Message: fmt.Sprintf("An error occurred while trying to get sc_file_count from Redis: %v", err),
+			Message: fmt.Sprintf("An error occurred while trying to get sc_file_count from the store: %v", err),
 		}, fasthttp.StatusOK)
 		return
 	}
 	stats.SizeStats.FileCount = fileCount
 
-	timeToComplete, err := getStatValueFromRedis(ctx, global.RedisClient, "sc_time_to_complete")
+	timeToComplete, err := global.Store.Get(ctx, "sc_time_to_complete")
 	if err != nil {
 		response.SendJSONResponse(ctx, response.JSONResponse{
 			Status:  response.RequestStatusInternalError,
 			Data:    nil,
-			Message: fmt.Sprintf("An error occurred while trying to get sc_time_to_complete from Redis: %v", err),
+			Message: fmt.Sprintf("An error occurred while trying to get sc_time_to_complete from the store: %v", err),
 		}, fasthttp.StatusOK)
 		return
 	}
 	stats.SizeStats.TimeToComplete = timeToComplete
 
-	lastUpdated, err := getStatValueFromRedis(ctx, global.RedisClient, "sc_last_updated")
+	lastUpdated, err := global.Store.Get(ctx, "sc_last_updated")
 	if err != nil {
 		response.SendJSONResponse(ctx, response.JSONResponse{
 			Status:  response.RequestStatusInternalError,
 			Data:    nil,
-			Message: fmt.Sprintf("An error occurred while trying to get sc_last_updated from Redis: %v", err),
+			Message: fmt.Sprintf("An error occurred while trying to get sc_last_updated from the store: %v", err),
 		}, fasthttp.StatusOK)
 		return
 	}
 	stats.SizeStats.LastUpdated = lastUpdated
 
-	if global.Configuration.MoreStats {
+	if global.Config().MoreStats {
 		stats.RuntimeVersion = runtime.Version()
+		stats.RuntimeStats = getRuntimeStats()
+
+		trafficStats, err := getTrafficStats(ctx)
+		if err != nil {
+			response.SendJSONResponse(ctx, response.JSONResponse{
+				Status:  response.RequestStatusInternalError,
+				Data:    nil,
+				Message: fmt.Sprintf("An error occurred while trying to get traffic stats from the store: %v", err),
+			}, fasthttp.StatusOK)
+			return
+		}
+		stats.TrafficStats = &trafficStats
 	}
 
 	response.SendJSONResponse(ctx, response.JSONResponse{
@@ -86,17 +120,26 @@ func ServeStats(ctx *fasthttp.RequestCtx) {
 	}, fasthttp.StatusOK)
 }
 
-func getStatValueFromRedis(ctx *fasthttp.RequestCtx, c *redis.Client, key string) (int64, error) {
-	v, e := c.Get(ctx, key).Result()
-	if e != nil {
-		if e == redis.Nil {
-			return 0, nil
-		}
-		return 0, e
+func getRuntimeStats() *RuntimeStats {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+
+	r := &RuntimeStats{
+		Uptime:     int64(time.Since(global.StartTime) / time.Second),
+		Goroutines: runtime.NumGoroutine(),
+		Memory: MemoryStats{
+			Alloc:        m.Alloc,
+			TotalAlloc:   m.TotalAlloc,
+			Sys:          m.Sys,
+			HeapInuse:    m.HeapInuse,
+			HeapObjects:  m.HeapObjects,
+			NumGC:        m.NumGC,
+			LastGC:       int64(m.LastGC / uint64(time.Millisecond)),
+			PauseTotalNs: m.PauseTotalNs,
+		},
 	}
-	i, e := strconv.ParseInt(v, 10, 64)
-	if e != nil {
-		return 0, e
+	if global.Server != nil {
+		r.ActiveConnections = global.Server.GetOpenConnectionsCount()
 	}
-	return i, nil
+	return r
 }
@@ -8,6 +8,7 @@ import (
 	"io"
 	"os"
 	"path"
+	"path/filepath"
 	"tytanium/constants"
 	"tytanium/encryption"
 	"tytanium/global"
@@ -22,6 +23,7 @@ const fileHandler = "file"
 // ServeUpload handles all incoming POST requests to /upload. It will take a multipart form, parse the file,
 // then write it to disk.
 func ServeUpload(ctx *fasthttp.RequestCtx) {
+	config := global.Config()
 	auth := security.IsAuthorized(ctx)
 	if !auth {
 		return
@@ -54,8 +56,8 @@ func ServeUpload(ctx *fasthttp.RequestCtx) {
 	}
 	f := mp.File[fileHandler][0]
 
-	if global.Configuration.RateLimit.Bandwidth.Upload > 0 && global.Configuration.RateLimit.Bandwidth.ResetAfter > 0 {
-		isUploadBandwidthLimitNotReached, err := security.Try(ctx, global.RedisClient, fmt.Sprintf("%s_%s", constants.RateLimitBandwidthUpload, utils.GetIP(ctx)), int64(global.Configuration.RateLimit.Bandwidth.Upload), int64(global.Configuration.RateLimit.Bandwidth.ResetAfter), f.Size)
+	if client := security.IdentifyClient(ctx); !client.Exempt && config.RateLimit.Bandwidth.Upload > 0 && config.RateLimit.Bandwidth.ResetAfter > 0 {
+		bandwidthResult, err := security.Try(ctx, fmt.Sprintf("%s_%s", constants.RateLimitBandwidthUpload, client.Key), int64(config.RateLimit.Bandwidth.Upload), int64(config.RateLimit.Bandwidth.ResetAfter), f.Size)
 		if err != nil {
 			response.SendJSONResponse(ctx, response.JSONResponse{
 				Status:  response.RequestStatusInternalError,
@@ -64,7 +66,9 @@ func ServeUpload(ctx *fasthttp.RequestCtx) {
 			}, fasthttp.StatusOK)
 			return
 		}
-		if !isUploadBandwidthLimitNotReached {
+		if !bandwidthResult.Allowed {
+			// the bandwidth limit is what the client has to wait for now, so it replaces the request limit's headers
+			security.SetHeaders(ctx, bandwidthResult)
 			response.SendJSONResponse(ctx, response.JSONResponse{
 				Status:  response.RequestStatusError,
 				Data:    nil,
@@ -124,26 +128,54 @@ func ServeUpload(ctx *fasthttp.RequestCtx) {
 		return
 	}
 
-	var fileName string
+	var fileId, fileName string
+	var destFile *os.File
 	attempts := 0
 
-	// loop until an unoccupied id is found
+	// loop until an unoccupied id is found. The file is written to a temp file named after the ID first, which
+	// reserves the ID, as only one upload can create it. It's only moved to its final name once it's complete.
 	for {
+		fileId = utils.RandString(config.Storage.IDLength)
 
-		fileId := utils.RandString(global.Configuration.Storage.IDLength)
-		fileName = fileId + ext
-
-		i, e := os.Stat(path.Join(global.Configuration.Storage.Directory, fileName))
-		if e != nil {
-			if os.IsNotExist(e) || e == os.ErrNotExist {
+		f, err := createTempFile(utils.FileDir(fileId), fileId)
+		if err == nil {
+			// checked after reserving the ID, so an upload of the same ID finishing in the meantime is seen
+			inUse, err := idInUse(fileId)
+			if err != nil {
+				_ = f.Close()
+				_ = os.Remove(f.Name())
+				response.SendJSONResponse(ctx, response.JSONResponse{
+					Status:  response.RequestStatusInternalError,
+					Data:    nil,
+					Message: fmt.Sprintf("Failed to check if the file ID is in use. %v", err),
+				}, fasthttp.StatusOK)
+				return
+			}
+			if !inUse {
+				destFile, fileName = f, fileId+ext
 				break
 			}
+			_ = f.Close()
+			_ = os.Remove(f.Name())
+		} else if !os.IsExist(err) {
+			if os.IsPermission(err) {
+				response.SendJSONResponse(ctx, response.JSONResponse{
+					Status:  response.RequestStatusInternalError,
+					Data:    nil,
+					Message: fmt.Sprintf("Permission to create the file was denied. %v", err),
+				}, fasthttp.StatusOK)
+				return
+			}
+			response.SendJSONResponse(ctx, response.JSONResponse{
+				Status:  response.RequestStatusInternalError,
+				Data:    nil,
+				Message: fmt.Sprintf("Failed to create the file. %v", err),
+			}, fasthttp.StatusOK)
+			return
 		}
-		if i == nil {
-			break
-		}
+
 		attempts++
-		if attempts >= global.Configuration.Storage.CollisionCheckAttempts {
+		if attempts >= config.Storage.CollisionCheckAttempts {
 			response.SendJSONResponse(ctx, response.JSONResponse{
 				Status:  response.RequestStatusError,
 				Data:    nil,
@@ -152,32 +184,54 @@ func ServeUpload(ctx *fasthttp.RequestCtx) {
 			return
 		}
 	}
+	// the file is stored by its ID alone, and the extension is kept in its header
+	destPath := filepath.Join(filepath.Dir(destFile.Name()), fileId)
 
-	destFile, err := os.Create(path.Join(global.Configuration.Storage.Directory, fileName))
+	// a file that wasn't written completely can't be decrypted, so it's removed
+	completed := false
+	trackUpload(destFile.Name())
 	defer func() {
-		_ = destFile.Close()
+		if completed {
+			storeFile(destFile.Name(), destPath)
+		} else {
+			_ = destFile.Close()
+			_ = os.Remove(destFile.Name())
+			releaseSpace(destFile.Name())
+		}
+		untrackUpload(destFile.Name())
 	}()
 
+	encryptedSize, err := sio.EncryptedSize(uint64(f.Size))
+	if err != nil {
+		response.SendJSONResponse(ctx, response.JSONResponse{
+			Status:  response.RequestStatusError,
+			Data:    nil,
+			Message: fmt.Sprintf("File is too large to be encrypted. %v", err),
+		}, fasthttp.StatusOK)
+		return
+	}
+	err = reserveSpace(destFile.Name(), filepath.Dir(destPath), fileHeaderSize(ext)+int64(encryptedSize))
+	if err == errDiskFull || err == errStorageFull {
+		logger.Warn("Upload rejected, storage is full", logger.RequestFields(ctx, logger.Fields{"size": f.Size, "reason": err.Error()}))
+		response.SendJSONResponse(ctx, response.JSONResponse{
+			Status:  response.RequestStatusError,
+			Data:    nil,
+			Message: "There is not enough storage space left for this file.",
+		}, fasthttp.StatusInsufficientStorage)
+		return
+	}
 	if err != nil {
-		if err == os.ErrPermission {
-			response.SendJSONResponse(ctx, response.JSONResponse{
-				Status:  response.RequestStatusInternalError,
-				Data:    nil,
-				Message: fmt.Sprintf("Permission to create the file was denied. %v", err),
-			}, fasthttp.StatusOK)
-			return
-		}
 		response.SendJSONResponse(ctx, response.JSONResponse{
 			Status:  response.RequestStatusInternalError,
 			Data:    nil,
-			Message: fmt.Sprintf("Failed to create the file. %v", err),
+			Message: fmt.Sprintf("Storage space couldn't be checked. %v", err),
 		}, fasthttp.StatusOK)
 		return
 	}
 
-	masterKey := utils.RandString(global.Configuration.Encryption.EncryptionKeyLength)
+	masterKey := utils.RandString(config.Encryption.EncryptionKeyLength)
 
-	key, err := encryption.DeriveKey([]byte(masterKey), []byte(global.Configuration.Encryption.Nonce))
+	key, err := encryption.DeriveKey([]byte(masterKey), []byte(config.Encryption.Nonce))
 	if err != nil {
 		response.SendJSONResponse(ctx, response.JSONResponse{
 			Status:  response.RequestStatusInternalError,
@@ -187,6 +241,15 @@ func ServeUpload(ctx *fasthttp.RequestCtx) {
 		return
 	}
 
+	if err = writeFileHeader(destFile, ext); err != nil {
+		response.SendJSONResponse(ctx, response.JSONResponse{
+			Status:  response.RequestStatusInternalError,
+			Data:    nil,
+			Message: fmt.Sprintf("Failed to write the file header to disk. %v", err),
+		}, fasthttp.StatusOK)
+		return
+	}
+
 	if _, err = sio.Encrypt(destFile, openedFile, sio.Config{Key: key[:]}); err != nil {
 		if _, ok := err.(sio.Error); ok {
 			response.SendInvalidEncryptionKeyResponse(ctx)
@@ -200,13 +263,22 @@ func ServeUpload(ctx *fasthttp.RequestCtx) {
 		return
 	}
 
-	if global.Configuration.Logging.Enabled {
-		logger.InfoLogger.Printf("File %s was created, size: %d", fileName, f.Size)
+	if err = commitFile(destFile, destPath); err != nil {
+		response.SendJSONResponse(ctx, response.JSONResponse{
+			Status:  response.RequestStatusInternalError,
+			Data:    nil,
+			Message: fmt.Sprintf("Failed to save the file. %v", err),
+		}, fasthttp.StatusOK)
+		return
 	}
+	completed = true
+
+	logger.Info("File created", logger.RequestFields(ctx, logger.Fields{"file": fileName, "size": f.Size}))
+	recordTraffic(ctx, true, f.Size)
 
 	targetPath := fmt.Sprintf("%s?enc_key=%s", fileName, masterKey)
 
-	if global.Configuration.ForceZeroWidth || string(ctx.QueryArgs().Peek("zerowidth")) == "1" {
+	if config.ForceZeroWidth || string(ctx.QueryArgs().Peek("zerowidth")) == "1" {
 		targetPath = utils.StringToZeroWidth(targetPath)
 	}
 
@@ -218,7 +290,7 @@ func ServeUpload(ctx *fasthttp.RequestCtx) {
 			FileName      string `json:"file_name"`
 			EncryptionKey string `json:"encryption_key"`
 		}{
-			URI:           global.Configuration.Domain + "/" + targetPath,
+			URI:           config.Domain + "/" + targetPath,
 			Path:          targetPath,
 			FileName:      fileName,
 			EncryptionKey: masterKey,
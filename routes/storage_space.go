@@ -0,0 +1,327 @@
+package routes
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"tytanium/constants"
+	"tytanium/global"
+	"tytanium/logger"
+	"tytanium/utils"
+)
+
+// storageRescanInterval is how often the size of Storage.Directory can be counted again when an upload doesn't fit
+// under Storage.MaxTotalSize, in case files were deleted by something else (like "tytanium gc").
+const storageRescanInterval = time.Minute
+
+var (
+	// errStorageFull is returned by reserveSpace when the upload doesn't fit under Storage.MaxTotalSize.
+	errStorageFull = errors.New("the storage is full")
+	// errDiskFull is returned by checkDiskSpace when the upload would leave less free space than configured.
+	errDiskFull = errors.New("the disk is almost full")
+)
+
+// storage keeps track of what's stored while Storage.MaxTotalSize is set: the total size, counting the space reserved
+// by uploads in progress, and with Storage.EvictOldest, every file from the least recently modified, so the oldest
+// can be evicted without walking the directory. Both come from a walk of Storage.Directory, which runs without holding
+// the lock, and are kept up to date as uploads are stored.
+var storage = struct {
+	sync.Mutex
+	total int64
+	files []storedFile
+	// counted is true once a walk has counted the total, and indexed if files were kept for eviction as well
+	counted bool
+	indexed bool
+	scanned time.Time
+	// scanning is closed when the walk in progress finishes, or nil if none is running
+	scanning chan struct{}
+	scanErr  error
+	// stored are the files stored while a walk runs, which it may have missed
+	stored []storedFile
+}{}
+
+// storedFile is a file in Storage.Directory. Only its name is kept, as "tytanium migrate" may move it to the directory
+// of another layout; utils.FileDirs finds it in either.
+type storedFile struct {
+	name    string
+	size    int64
+	modTime time.Time
+}
+
+// scanStorage returns every stored file in dir, in both layouts, and their total size.
+func scanStorage(dir string) ([]storedFile, int64, error) {
+	var files []storedFile
+	var total int64
+	err := filepath.Walk(dir, func(p string, i os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		// temp files are counted by the uploads writing them
+		if !i.Mode().IsRegular() || strings.HasPrefix(i.Name(), constants.TempFilePrefix) {
+			return nil
+		}
+		files = append(files, storedFile{name: i.Name(), size: i.Size(), modTime: i.ModTime()})
+		total += i.Size()
+		return nil
+	})
+	return files, total, err
+}
+
+// ScanStorageUsage counts the size of Storage.Directory if Storage.MaxTotalSize is set, so the first upload doesn't
+// have to. It returns the size and how many files there are.
+func ScanStorageUsage() (int64, int, error) {
+	if global.Config().Storage.MaxTotalSize <= 0 {
+		return 0, 0, nil
+	}
+	files, err := rescanStorage(global.Config().Storage.Directory)
+	if err != nil {
+		return 0, 0, err
+	}
+	storage.Lock()
+	defer storage.Unlock()
+	return storage.total, files, nil
+}
+
+// rescanStorage walks dir to count what's stored, and returns how many files there are. If a walk is already running,
+// it waits for that one instead.
+func rescanStorage(dir string) (int, error) {
+	done, started := beginScan()
+	if !started {
+		<-done
+		storage.Lock()
+		defer storage.Unlock()
+		return 0, storage.scanErr
+	}
+	files, total, err := scanStorage(dir)
+	return finishScan(done, files, total, err)
+}
+
+// beginScan marks a walk as running, so files stored from now on are kept for finishScan. If one is running already,
+// started is false and done is closed once it finishes.
+func beginScan() (done chan struct{}, started bool) {
+	storage.Lock()
+	defer storage.Unlock()
+	if storage.scanning != nil {
+		return storage.scanning, false
+	}
+	storage.scanning = make(chan struct{})
+	storage.stored = nil
+	return storage.scanning, true
+}
+
+// finishScan publishes what a walk found, together with the files stored while it ran which it missed, and returns
+// how many files there are.
+func finishScan(done chan struct{}, files []storedFile, total int64, err error) (int, error) {
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].modTime.Before(files[j].modTime)
+	})
+
+	storage.Lock()
+	defer storage.Unlock()
+	defer close(done)
+	storage.scanning = nil
+	storage.scanErr = err
+	if err != nil {
+		storage.stored = nil
+		return 0, err
+	}
+
+	// files stored during the walk are the newest, so only the end of what it found has to be checked for them
+	if len(storage.stored) > 0 {
+		since := storage.stored[0].modTime.Add(-time.Second)
+		found := make(map[string]bool)
+		for i := len(files) - 1; i >= 0 && !files[i].modTime.Before(since); i-- {
+			found[files[i].name] = true
+		}
+		for _, f := range storage.stored {
+			if !found[f.name] {
+				files = append(files, f)
+				total += f.size
+			}
+		}
+		storage.stored = nil
+	}
+
+	storage.total = total + reservedByUploads()
+	storage.counted = true
+	storage.scanned = time.Now()
+	storage.files, storage.indexed = nil, false
+	if global.Config().Storage.EvictOldest {
+		storage.files, storage.indexed = files, true
+	}
+	return len(files), nil
+}
+
+// reservedByUploads returns the space reserved by uploads in progress.
+func reservedByUploads() int64 {
+	incompleteUploads.Lock()
+	defer incompleteUploads.Unlock()
+	var reserved int64
+	for _, size := range incompleteUploads.reserved {
+		reserved += size
+	}
+	return reserved
+}
+
+// reserveSpace reserves size bytes for the upload writing the temp file p, to be stored in dir. errDiskFull is
+// returned if they, with the space reserved by other uploads, would leave less free space than Storage.MinFreeSpace
+// or Storage.MinFreePercent. If they don't fit under Storage.MaxTotalSize, the oldest files are deleted to make room
+// with Storage.EvictOldest, otherwise errStorageFull is returned. The space is given back by releaseSpace if the
+// upload doesn't finish, or taken up by the file once storeFile is called.
+func reserveSpace(p string, dir string, size int64) error {
+	c := global.Config()
+	capped := c.Storage.MaxTotalSize > 0
+	for {
+		storage.Lock()
+		if !capped {
+			// the usage isn't kept up to date without a cap, so it's counted again once there is one
+			storage.counted, storage.indexed, storage.files = false, false, nil
+		}
+		if !capped || (storage.counted && (storage.indexed || !c.Storage.EvictOldest)) {
+			break
+		}
+		storage.Unlock()
+		if _, err := rescanStorage(c.Storage.Directory); err != nil {
+			return err
+		}
+	}
+	defer storage.Unlock()
+
+	if err := checkDiskSpace(dir, reservedByUploads()+size); err != nil {
+		return err
+	}
+	if capped {
+		limit := int64(c.Storage.MaxTotalSize)
+		if storage.total+size > limit {
+			if !c.Storage.EvictOldest || size > limit {
+				if storage.scanning == nil && time.Since(storage.scanned) >= storageRescanInterval {
+					go func() {
+						_, _ = rescanStorage(c.Storage.Directory)
+					}()
+				}
+				return errStorageFull
+			}
+			evictOldest(storage.total + size - limit)
+			if storage.total+size > limit {
+				// everything left belongs to uploads in progress
+				return errStorageFull
+			}
+		}
+		storage.total += size
+	}
+
+	incompleteUploads.Lock()
+	incompleteUploads.reserved[p] = size
+	incompleteUploads.Unlock()
+	return nil
+}
+
+// releaseSpace gives back the space reserved for the upload writing p.
+func releaseSpace(p string) {
+	incompleteUploads.Lock()
+	size, ok := incompleteUploads.reserved[p]
+	delete(incompleteUploads.reserved, p)
+	incompleteUploads.Unlock()
+	if !ok {
+		return
+	}
+	storage.Lock()
+	if storage.counted {
+		storage.total -= size
+	}
+	storage.Unlock()
+}
+
+// storeFile records that the upload writing p was stored at dest, which now takes up the space reserved for it.
+func storeFile(p string, dest string) {
+	incompleteUploads.Lock()
+	size, ok := incompleteUploads.reserved[p]
+	delete(incompleteUploads.reserved, p)
+	incompleteUploads.Unlock()
+	if !ok {
+		return
+	}
+	f := storedFile{name: filepath.Base(dest), size: size, modTime: time.Now()}
+	storage.Lock()
+	if storage.indexed {
+		storage.files = append(storage.files, f)
+	}
+	if storage.scanning != nil {
+		storage.stored = append(storage.stored, f)
+	}
+	storage.Unlock()
+}
+
+// evictOldest deletes the least recently modified files until at least need bytes were freed. Files that were already
+// deleted by something else only count towards it. storage must be locked.
+func evictOldest(need int64) {
+	var freed int64
+	evicted := 0
+	for freed < need && len(storage.files) > 0 {
+		f := storage.files[0]
+		storage.files[0] = storedFile{}
+		storage.files = storage.files[1:]
+
+		removed, err := removeStoredFile(f.name)
+		if err != nil {
+			// it's left out of the index, so eviction doesn't get stuck on it, but it still takes up space
+			logger.Error("Failed to evict a file", logger.Fields{"file": f.name, "error": err})
+			continue
+		}
+		freed += f.size
+		storage.total -= f.size
+		if removed {
+			evicted++
+			logger.Info("File evicted", logger.Fields{"file": f.name, "size": f.size, "modified": f.modTime})
+		}
+	}
+	if evicted > 0 {
+		log.Printf("Storage.MaxTotalSize reached, deleted the %d oldest file(s) to free %d bytes", evicted, freed)
+	}
+}
+
+// removeStoredFile deletes the stored file name from the directories of both layouts, as it may be in either while
+// it's migrated, and reports whether it was found at all.
+func removeStoredFile(name string) (bool, error) {
+	removed := false
+	for _, dir := range utils.FileDirs(name) {
+		err := os.Remove(filepath.Join(dir, name))
+		if err == nil {
+			removed = true
+		} else if !os.IsNotExist(err) {
+			return removed, err
+		}
+	}
+	return removed, nil
+}
+
+// checkDiskSpace returns errDiskFull if writing size bytes to dir would leave less than Storage.MinFreeSpace bytes
+// or Storage.MinFreePercent percent of its disk free. If the free space can't be read on this platform,
+// the check passes.
+func checkDiskSpace(dir string, size int64) error {
+	c := global.Config()
+	if c.Storage.MinFreeSpace <= 0 && c.Storage.MinFreePercent <= 0 {
+		return nil
+	}
+	s, err := utils.GetDiskSpace(dir)
+	if err == utils.ErrDiskSpaceUnsupported {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("the free disk space couldn't be read, %v", err)
+	}
+	left := int64(s.Free) - size
+	if left < int64(c.Storage.MinFreeSpace) {
+		return errDiskFull
+	}
+	if s.Total > 0 && float64(left)/float64(s.Total)*100 < c.Storage.MinFreePercent {
+		return errDiskFull
+	}
+	return nil
+}
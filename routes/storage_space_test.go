@@ -0,0 +1,219 @@
+package routes
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+	"tytanium/api"
+	"tytanium/global"
+	"tytanium/utils"
+)
+
+// setupStorage points the configuration at an empty storage directory with the given cap, and forgets what was
+// counted by an earlier test.
+func setupStorage(t *testing.T, maxTotalSize int, evict bool) string {
+	t.Helper()
+	dir := t.TempDir()
+	c := &api.Configuration{}
+	c.Storage.Directory = dir
+	c.Storage.Layout = utils.LayoutFlat
+	c.Storage.ShardLength = 2
+	c.Storage.MaxTotalSize = maxTotalSize
+	c.Storage.EvictOldest = evict
+	global.SetConfig(c)
+
+	storage.Lock()
+	storage.total, storage.files = 0, nil
+	storage.counted, storage.indexed = false, false
+	storage.scanned, storage.scanning, storage.scanErr, storage.stored = time.Time{}, nil, nil, nil
+	storage.Unlock()
+	incompleteUploads.Lock()
+	incompleteUploads.reserved = make(map[string]int64)
+	incompleteUploads.Unlock()
+	return dir
+}
+
+// writeStoredFile stores a file of size bytes named name in dir, last modified age ago.
+func writeStoredFile(t *testing.T, dir string, name string, size int, age time.Duration) {
+	t.Helper()
+	p := filepath.Join(dir, name)
+	if err := os.WriteFile(p, make([]byte, size), 0600); err != nil {
+		t.Fatal(err)
+	}
+	modTime := time.Now().Add(-age)
+	if err := os.Chtimes(p, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// upload stores a file of size bytes named name in dir the way ServeUpload does.
+func upload(t *testing.T, dir string, name string, size int) error {
+	t.Helper()
+	temp := filepath.Join(dir, ".tmp-"+name)
+	if err := reserveSpace(temp, dir, int64(size)); err != nil {
+		return err
+	}
+	writeStoredFile(t, dir, name, size, 0)
+	storeFile(temp, filepath.Join(dir, name))
+	return nil
+}
+
+func checkStored(t *testing.T, dir string, want ...string) {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, e := range entries {
+		if !e.IsDir() {
+			got = append(got, e.Name())
+		}
+	}
+	if len(got) != len(want) {
+		t.Fatalf("stored %q, want %q", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("stored %q, want %q", got, want)
+		}
+	}
+}
+
+func checkTotal(t *testing.T, want int64) {
+	t.Helper()
+	storage.Lock()
+	defer storage.Unlock()
+	if storage.total != want {
+		t.Errorf("total = %d, want %d", storage.total, want)
+	}
+}
+
+func TestReserveSpaceCap(t *testing.T) {
+	dir := setupStorage(t, 100, false)
+	writeStoredFile(t, dir, "aaaa", 60, time.Hour)
+
+	if err := reserveSpace(filepath.Join(dir, ".tmp-bbbb"), dir, 30); err != nil {
+		t.Fatalf("reserving 30 of the 40 bytes left: %v", err)
+	}
+	checkTotal(t, 90)
+	if err := reserveSpace(filepath.Join(dir, ".tmp-cccc"), dir, 20); err != errStorageFull {
+		t.Fatalf("reserving 20 of the 10 bytes left: got %v, want errStorageFull", err)
+	}
+
+	releaseSpace(filepath.Join(dir, ".tmp-bbbb"))
+	checkTotal(t, 60)
+	if err := reserveSpace(filepath.Join(dir, ".tmp-cccc"), dir, 20); err != nil {
+		t.Fatalf("reserving 20 bytes once the reservation was released: %v", err)
+	}
+	checkStored(t, dir, "aaaa")
+}
+
+func TestEvictOldest(t *testing.T) {
+	dir := setupStorage(t, 100, true)
+	writeStoredFile(t, dir, "bbbb", 30, 2*time.Hour)
+	writeStoredFile(t, dir, "aaaa", 30, 3*time.Hour)
+	writeStoredFile(t, dir, "cccc", 30, time.Hour)
+
+	if err := upload(t, dir, "dddd", 20); err != nil {
+		t.Fatal(err)
+	}
+	checkStored(t, dir, "bbbb", "cccc", "dddd")
+	checkTotal(t, 80)
+
+	if err := upload(t, dir, "eeee", 40); err != nil {
+		t.Fatal(err)
+	}
+	checkStored(t, dir, "cccc", "dddd", "eeee")
+	checkTotal(t, 90)
+
+	// uploads are evicted like any other file once they're the oldest
+	if err := upload(t, dir, "ffff", 100); err != nil {
+		t.Fatal(err)
+	}
+	checkStored(t, dir, "ffff")
+	checkTotal(t, 100)
+
+	if err := upload(t, dir, "gggg", 101); err != errStorageFull {
+		t.Fatalf("uploading more than the cap: got %v, want errStorageFull", err)
+	}
+	checkStored(t, dir, "ffff")
+}
+
+func TestEvictOldestFindsMigratedFiles(t *testing.T) {
+	dir := setupStorage(t, 100, true)
+	writeStoredFile(t, dir, "aaaa", 50, 2*time.Hour)
+	writeStoredFile(t, dir, "bbbb", 50, time.Hour)
+	if _, err := rescanStorage(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	// what "tytanium migrate" does after the layout is changed to sharded
+	global.Config().Storage.Layout = utils.LayoutSharded
+	if err := os.Mkdir(filepath.Join(dir, "aa"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(filepath.Join(dir, "aaaa"), filepath.Join(dir, "aa", "aaaa")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := upload(t, dir, "cccc", 50); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "aa", "aaaa")); !os.IsNotExist(err) {
+		t.Errorf("the migrated file wasn't evicted: %v", err)
+	}
+	checkStored(t, dir, "bbbb", "cccc")
+	checkTotal(t, 100)
+}
+
+func TestStoreDuringScan(t *testing.T) {
+	tests := []struct {
+		name string
+		// walkedAfterStore is true if the walk finds the stored file, false if it had passed it already
+		walkedAfterStore bool
+	}{
+		{"stored after the walk passed it", false},
+		{"stored before the walk reached it", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := setupStorage(t, 1000, true)
+			writeStoredFile(t, dir, "aaaa", 100, time.Hour)
+			if _, err := rescanStorage(dir); err != nil {
+				t.Fatal(err)
+			}
+			temp := filepath.Join(dir, ".tmp-bbbb")
+			if err := reserveSpace(temp, dir, 50); err != nil {
+				t.Fatal(err)
+			}
+
+			done, started := beginScan()
+			if !started {
+				t.Fatal("a scan is already running")
+			}
+			var files []storedFile
+			var total int64
+			var err error
+			if !tt.walkedAfterStore {
+				files, total, err = scanStorage(dir)
+			}
+			writeStoredFile(t, dir, "bbbb", 50, 0)
+			storeFile(temp, filepath.Join(dir, "bbbb"))
+			if tt.walkedAfterStore {
+				files, total, err = scanStorage(dir)
+			}
+			if _, err := finishScan(done, files, total, err); err != nil {
+				t.Fatal(err)
+			}
+
+			checkTotal(t, 150)
+			storage.Lock()
+			defer storage.Unlock()
+			if len(storage.files) != 2 || storage.files[0].name != "aaaa" || storage.files[1].name != "bbbb" {
+				t.Errorf("indexed %v, want aaaa and bbbb", storage.files)
+			}
+		})
+	}
+}
@@ -0,0 +1,104 @@
+package routes
+
+import (
+	"context"
+	"fmt"
+	"time"
+	"tytanium/constants"
+	"tytanium/global"
+	"tytanium/logger"
+)
+
+const (
+	trafficUploadCount     = "up_count"
+	trafficUploadBytes     = "up_bytes"
+	trafficDownloadCount   = "dn_count"
+	trafficDownloadBytes   = "dn_bytes"
+	trafficMinuteBucketLen = 5 * time.Minute
+	trafficHourBucketLen   = time.Hour
+)
+
+// TrafficWindow holds the amount of uploads and downloads seen over a period of time.
+type TrafficWindow struct {
+	Uploads         int64 `json:"uploads"`
+	UploadedBytes   int64 `json:"uploaded_bytes"`
+	Downloads       int64 `json:"downloads"`
+	DownloadedBytes int64 `json:"downloaded_bytes"`
+}
+
+// TrafficStats represent the rolling traffic stats returned by /stats if MoreStats is enabled.
+type TrafficStats struct {
+	LastHour TrafficWindow `json:"last_hour"`
+	LastDay  TrafficWindow `json:"last_day"`
+}
+
+// recordTraffic adds a transfer of the given size to the current traffic buckets.
+// Traffic is only tracked if MoreStats is enabled, and failing to record it never fails the request.
+func recordTraffic(ctx context.Context, upload bool, size int64) {
+	if !global.Config().MoreStats {
+		return
+	}
+	countField, bytesField := trafficDownloadCount, trafficDownloadBytes
+	if upload {
+		countField, bytesField = trafficUploadCount, trafficUploadBytes
+	}
+
+	now := time.Now()
+	minuteKey := trafficBucketKey(constants.StatsTrafficMinuteBucket, now, trafficMinuteBucketLen)
+	hourKey := trafficBucketKey(constants.StatsTrafficHourBucket, now, trafficHourBucketLen)
+
+	fields := map[string]int64{countField: 1, bytesField: size}
+	// keep each bucket around for one window longer than it's needed
+	err := global.Store.IncrFields(ctx, minuteKey, fields, time.Hour+trafficMinuteBucketLen)
+	if err == nil {
+		err = global.Store.IncrFields(ctx, hourKey, fields, 24*time.Hour+trafficHourBucketLen)
+	}
+	if err != nil {
+		logger.Error("Failed to record traffic stats", logger.Fields{"error": err})
+	}
+}
+
+// getTrafficStats sums up the buckets covering the last hour and the last day.
+func getTrafficStats(ctx context.Context) (TrafficStats, error) {
+	var stats TrafficStats
+	now := time.Now()
+
+	lastHour, err := sumTrafficBuckets(ctx, constants.StatsTrafficMinuteBucket, now, trafficMinuteBucketLen, int(time.Hour/trafficMinuteBucketLen))
+	if err != nil {
+		return stats, err
+	}
+	stats.LastHour = lastHour
+
+	lastDay, err := sumTrafficBuckets(ctx, constants.StatsTrafficHourBucket, now, trafficHourBucketLen, int(24*time.Hour/trafficHourBucketLen))
+	if err != nil {
+		return stats, err
+	}
+	stats.LastDay = lastDay
+
+	return stats, nil
+}
+
+func sumTrafficBuckets(ctx context.Context, prefix string, now time.Time, bucketLen time.Duration, count int) (TrafficWindow, error) {
+	var w TrafficWindow
+	keys := make([]string, 0, count)
+	for i := 0; i < count; i++ {
+		keys = append(keys, trafficBucketKey(prefix, now.Add(-time.Duration(i)*bucketLen), bucketLen))
+	}
+	buckets, err := global.Store.GetFields(ctx, keys)
+	if err != nil {
+		return w, err
+	}
+
+	for _, bucket := range buckets {
+		w.Uploads += bucket[trafficUploadCount]
+		w.UploadedBytes += bucket[trafficUploadBytes]
+		w.Downloads += bucket[trafficDownloadCount]
+		w.DownloadedBytes += bucket[trafficDownloadBytes]
+	}
+	return w, nil
+}
+
+// trafficBucketKey returns the key of the bucket that t falls into, like st_1h_460000 for hour 460000 since the epoch.
+func trafficBucketKey(prefix string, t time.Time, bucketLen time.Duration) string {
+	return fmt.Sprintf("%s%d", prefix, t.Unix()/int64(bucketLen/time.Second))
+}
@@ -0,0 +1,143 @@
+package routes
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"tytanium/constants"
+	"tytanium/global"
+	"tytanium/utils"
+)
+
+// incompleteUploads holds the paths of the files uploads are writing, so they can be removed
+// if the server has to stop before the uploads finish, and the space reserved for them by reserveSpace.
+var incompleteUploads = struct {
+	sync.Mutex
+	paths    map[string]struct{}
+	reserved map[string]int64
+}{paths: make(map[string]struct{}), reserved: make(map[string]int64)}
+
+func trackUpload(p string) {
+	incompleteUploads.Lock()
+	incompleteUploads.paths[p] = struct{}{}
+	incompleteUploads.Unlock()
+}
+
+func untrackUpload(p string) {
+	incompleteUploads.Lock()
+	delete(incompleteUploads.paths, p)
+	incompleteUploads.Unlock()
+}
+
+// IsIncompleteUpload reports whether p is the file of an upload that's still being written.
+func IsIncompleteUpload(p string) bool {
+	incompleteUploads.Lock()
+	defer incompleteUploads.Unlock()
+	_, ok := incompleteUploads.paths[p]
+	return ok
+}
+
+// RemoveIncompleteUploads deletes the files of the uploads that are still being written, and returns how many
+// were deleted. It's used when the server stops without waiting for them.
+func RemoveIncompleteUploads() int {
+	incompleteUploads.Lock()
+	defer incompleteUploads.Unlock()
+	removed := 0
+	for p := range incompleteUploads.paths {
+		if err := os.Remove(p); err == nil {
+			removed++
+		}
+		delete(incompleteUploads.paths, p)
+	}
+	return removed
+}
+
+// createTempFile creates the temp file an upload with the given ID is written to in dir, creating dir if it's
+// a shard that doesn't exist yet. It fails with an error satisfying os.IsExist if another upload is using the ID right now.
+func createTempFile(dir string, id string) (*os.File, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return os.OpenFile(filepath.Join(dir, constants.TempFilePrefix+id), os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+}
+
+// legacyIDs holds the IDs of the files stored before files were stored by their ID alone, which are named with their
+// extension. They're listed once on startup by LoadLegacyIDs, as no new ones are stored, so idInUse doesn't have to
+// list the directory to find them.
+var legacyIDs = struct {
+	sync.RWMutex
+	ids map[string]struct{}
+}{ids: make(map[string]struct{})}
+
+// LoadLegacyIDs lists the files in Storage.Directory named with their extension, so their IDs aren't used again
+// with another extension. It returns how many there are.
+func LoadLegacyIDs() (int, error) {
+	ids := make(map[string]struct{})
+	err := filepath.Walk(global.Config().Storage.Directory, func(p string, i os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		name := i.Name()
+		if i.IsDir() || strings.HasPrefix(name, constants.TempFilePrefix) || len(path.Ext(name)) == 0 {
+			return nil
+		}
+		ids[strings.TrimSuffix(name, path.Ext(name))] = struct{}{}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	legacyIDs.Lock()
+	legacyIDs.ids = ids
+	legacyIDs.Unlock()
+	return len(ids), nil
+}
+
+// idInUse reports whether a file with the ID is stored. Files are stored by their ID alone, so an ID is only used once
+// no matter the extension. Both layouts are checked, as files may not have been migrated yet.
+func idInUse(id string) (bool, error) {
+	legacyIDs.RLock()
+	_, legacy := legacyIDs.ids[id]
+	legacyIDs.RUnlock()
+	if legacy {
+		return true, nil
+	}
+	for _, dir := range utils.FileDirs(id) {
+		_, err := os.Lstat(filepath.Join(dir, id))
+		if err == nil {
+			return true, nil
+		}
+		if !os.IsNotExist(err) {
+			return false, err
+		}
+	}
+	return false, nil
+}
+
+// commitFile makes sure everything written to f is on disk, closes it and moves it to dest, so a file only ever
+// appears at dest complete. A file already at dest is never replaced; an error satisfying os.IsExist is returned instead.
+func commitFile(f *os.File, dest string) error {
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	// unlike a rename, a link fails if dest exists
+	if err := os.Link(f.Name(), dest); err == nil {
+		_ = os.Remove(f.Name())
+	} else if os.IsExist(err) {
+		return err
+	} else if err := os.Rename(f.Name(), dest); err != nil {
+		// hard links aren't supported by every filesystem
+		return err
+	}
+	// the rename itself is only durable once the directory is synced, which isn't possible on every platform
+	if d, err := os.Open(filepath.Dir(dest)); err == nil {
+		_ = d.Sync()
+		_ = d.Close()
+	}
+	return nil
+}
@@ -9,7 +9,7 @@ import (
 // IsAuthorized compares the Authorization header to the master key. If they don't match,
 // HTTP status code 401 is returned.
 func IsAuthorized(ctx *fasthttp.RequestCtx) bool {
-	if string(ctx.Request.Header.Peek("authorization")) != global.Configuration.Security.MasterKey {
+	if string(ctx.Request.Header.Peek("authorization")) != global.Config().Security.MasterKey {
 		response.SendJSONResponse(ctx, response.JSONResponse{
 			Status:  response.RequestStatusError,
 			Data:    nil,
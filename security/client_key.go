@@ -0,0 +1,36 @@
+package security
+
+import (
+	"github.com/valyala/fasthttp"
+	"net"
+	"tytanium/global"
+	"tytanium/utils"
+)
+
+// ClientKey returns what identifies the client in rate limit and bandwidth keys: the client's IP, reduced to its
+// network of RateLimit.IPv4Prefix or RateLimit.IPv6Prefix bits, so that a client can't get around rate limits
+// by switching between the many addresses of its IPv6 /64 (or IPv4 /24, if configured).
+// If the prefix covers the whole address, the IP is returned as is, like 192.168.1.1; otherwise it's returned
+// as a network, like 2001:db8:1:2::/64.
+func ClientKey(ctx *fasthttp.RequestCtx) string {
+	ip := utils.GetIP(ctx)
+	c := global.Config().RateLimit
+	return networkKey(ip, c.IPv4Prefix, c.IPv6Prefix)
+}
+
+func networkKey(ip string, ipv4Prefix int, ipv6Prefix int) string {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return ip
+	}
+
+	prefix, bits := ipv6Prefix, 128
+	if v4 := parsed.To4(); v4 != nil {
+		parsed, prefix, bits = v4, ipv4Prefix, 32
+	}
+	if prefix <= 0 || prefix >= bits {
+		return parsed.String()
+	}
+	n := net.IPNet{IP: parsed.Mask(net.CIDRMask(prefix, bits)), Mask: net.CIDRMask(prefix, bits)}
+	return n.String()
+}
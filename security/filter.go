@@ -20,7 +20,8 @@ const (
 // FilterFail means a response was already returned, and the caller should terminate its function.
 // FilterSanitize means the file's Content-Type header returned to the client should be changed to text/plain.
 func FilterCheck(ctx *fasthttp.RequestCtx, mimeType string) FilterStatus {
-	if len(global.Configuration.Filter.Blacklist) > 0 && mimetype.EqualsAny(mimeType, global.Configuration.Filter.Blacklist...) {
+	config := global.Config()
+	if len(config.Filter.Blacklist) > 0 && mimetype.EqualsAny(mimeType, config.Filter.Blacklist...) {
 		response.SendJSONResponse(ctx, response.JSONResponse{
 			Status:  response.RequestStatusError,
 			Data:    nil,
@@ -28,7 +29,7 @@ func FilterCheck(ctx *fasthttp.RequestCtx, mimeType string) FilterStatus {
 		}, fasthttp.StatusOK)
 		return FilterFail
 	}
-	if len(global.Configuration.Filter.Whitelist) > 0 && !mimetype.EqualsAny(mimeType, global.Configuration.Filter.Whitelist...) {
+	if len(config.Filter.Whitelist) > 0 && !mimetype.EqualsAny(mimeType, config.Filter.Whitelist...) {
 		response.SendJSONResponse(ctx, response.JSONResponse{
 			Status:  response.RequestStatusError,
 			Data:    nil,
@@ -36,7 +37,7 @@ func FilterCheck(ctx *fasthttp.RequestCtx, mimeType string) FilterStatus {
 		}, fasthttp.StatusOK)
 		return FilterFail
 	}
-	if len(global.Configuration.Filter.Sanitize) > 0 && mimetype.EqualsAny(mimeType, global.Configuration.Filter.Sanitize...) {
+	if len(config.Filter.Sanitize) > 0 && mimetype.EqualsAny(mimeType, config.Filter.Sanitize...) {
 		return FilterSanitize
 	}
 	return FilterPass
@@ -0,0 +1,40 @@
+package security
+
+import (
+	"github.com/valyala/fasthttp"
+	"strconv"
+	"time"
+	"tytanium/constants"
+)
+
+// SetHeaders sets the RateLimit-Limit, RateLimit-Remaining and RateLimit-Reset headers for r, and Retry-After if r
+// wasn't allowed, so clients know when to back off. Times are given in whole seconds, rounded up.
+func SetHeaders(ctx *fasthttp.RequestCtx, r Result) {
+	reset := strconv.FormatInt(seconds(r.Reset), 10)
+	ctx.Response.Header.Set(constants.RateLimitLimitHeader, strconv.FormatInt(r.Limit, 10))
+	ctx.Response.Header.Set(constants.RateLimitRemainingHeader, strconv.FormatInt(r.Remaining, 10))
+	ctx.Response.Header.Set(constants.RateLimitResetHeader, reset)
+	if !r.Allowed {
+		ctx.Response.Header.Set(constants.RetryAfterHeader, reset)
+	}
+}
+
+// MostRestrictive returns the result which was denied, or, if all of them were allowed, the one with the least
+// remaining. That's the one a client has to respect when a request counts towards several limits.
+func MostRestrictive(results ...Result) Result {
+	var m Result
+	for i, r := range results {
+		if i == 0 || (m.Allowed && !r.Allowed) || (m.Allowed == r.Allowed && r.Remaining < m.Remaining) {
+			m = r
+		}
+	}
+	return m
+}
+
+func seconds(d time.Duration) int64 {
+	s := int64(d / time.Second)
+	if d%time.Second > 0 {
+		s++
+	}
+	return s
+}
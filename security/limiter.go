@@ -2,49 +2,69 @@ package security
 
 import (
 	"context"
-	"github.com/go-redis/redis/v8"
-	"strconv"
 	"time"
 )
 
-// Try checks to see if the ID exceeds the max count specified. Additionally, a time to reset the limit and the increment amount is also specified.
-// Based on https://github.com/etcinit/speedbump/blob/6ba8259841f7fb6dad77d2163bbf1c3794dc1853/speedbump.go#L99.
-func Try(ctx context.Context, redisClient *redis.Client, id string, max int64, resetAfter int64, incrBy int64) (bool, error) {
-	exists := true
-	val, err := redisClient.Get(ctx, id).Result()
-	if err != nil {
-		if err == redis.Nil {
-			exists = false
-		} else {
-			return false, err
-		}
-	}
-
-	if exists {
-		intVal, err := strconv.ParseInt(val, 10, 64)
-		if err != nil {
-			return false, err
-		}
-
-		if intVal >= max {
-			return false, nil
-		}
-	}
-
-	err = redisClient.Watch(ctx, func(rx *redis.Tx) error {
-		_, err := rx.Pipelined(ctx, func(pipeliner redis.Pipeliner) error {
-			if err := pipeliner.IncrBy(ctx, id, incrBy).Err(); err != nil {
-				return err
-			}
-			return pipeliner.Expire(ctx, id, time.Duration(resetAfter)*time.Millisecond).Err()
-		})
-
-		return err
-	})
-
-	if err != nil {
-		return false, err
-	}
-
-	return true, nil
+const (
+	// AlgorithmFixedWindow counts usage in windows of resetAfter, starting with the first request of each window.
+	AlgorithmFixedWindow = "fixed_window"
+	// AlgorithmSlidingWindowLog remembers every request made in the last resetAfter. It's exact, but uses
+	// memory for every request in the window.
+	AlgorithmSlidingWindowLog = "sliding_window_log"
+	// AlgorithmSlidingWindowCounter estimates usage in the last resetAfter from the counts of the current and
+	// previous fixed windows.
+	AlgorithmSlidingWindowCounter = "sliding_window_counter"
+	// AlgorithmTokenBucket refills max tokens evenly over resetAfter, allowing bursts of up to max.
+	AlgorithmTokenBucket = "token_bucket"
+)
+
+// Result is the outcome of a Try.
+type Result struct {
+	// Allowed is true if the usage was within the limit and has been counted.
+	Allowed bool
+	// Limit is the max given to Try.
+	Limit int64
+	// Remaining is how much can still be used right now.
+	Remaining int64
+	// Reset is how long it takes until usage is fully available again (or, if not allowed, until it's allowed again).
+	Reset time.Duration
+}
+
+// Limiter counts usage towards limits.
+type Limiter interface {
+	// Try counts incrBy towards the limit of max per resetAfter milliseconds for the ID, using the algorithm set in
+	// RateLimit.Algorithm. Usage is only counted if it's allowed.
+	Try(ctx context.Context, id string, max int64, resetAfter int64, incrBy int64) (Result, error)
+}
+
+// limiter is used by Try. It's set once on startup by SetLimiter.
+var limiter Limiter
+
+// SetLimiter sets the Limiter used by Try. It must be called before the server starts handling requests.
+func SetLimiter(l Limiter) {
+	limiter = l
+}
+
+// Try counts incrBy towards the limit of max per resetAfter milliseconds for the ID with the Limiter set by SetLimiter.
+func Try(ctx context.Context, id string, max int64, resetAfter int64, incrBy int64) (Result, error) {
+	return limiter.Try(ctx, id, max, resetAfter, incrBy)
+}
+
+// IsAlgorithm reports whether a is a supported rate limit algorithm.
+func IsAlgorithm(a string) bool {
+	_, ok := limiterKeySuffixes[a]
+	return ok
+}
+
+// limiterKeySuffixes keep the keys of each algorithm apart, as they store different data.
+var limiterKeySuffixes = map[string]string{
+	AlgorithmFixedWindow:          "",
+	AlgorithmSlidingWindowLog:     "_swl",
+	AlgorithmSlidingWindowCounter: "_swc",
+	AlgorithmTokenBucket:          "_tb",
+}
+
+// millis returns t in milliseconds since the epoch.
+func millis(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
 }
@@ -0,0 +1,87 @@
+package security
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+	"tytanium/store"
+)
+
+// BoltLimiter keeps its counters in the database file of a bolt store. It behaves like MemoryLimiter, but the
+// counters are kept across restarts. Every rate limited request writes to the file, though concurrent ones are
+// written together.
+type BoltLimiter struct {
+	DB *store.Bolt
+}
+
+// boltEntry is how a memoryEntry is saved in the database.
+type boltEntry struct {
+	Count       int64      `json:"c,omitempty"`
+	WindowEnd   int64      `json:"we,omitempty"`
+	Log         [][2]int64 `json:"l,omitempty"`
+	WindowStart int64      `json:"ws,omitempty"`
+	Current     int64      `json:"cu,omitempty"`
+	Previous    int64      `json:"p,omitempty"`
+	Tokens      float64    `json:"t,omitempty"`
+	Updated     int64      `json:"u,omitempty"`
+}
+
+// Try implements Limiter.
+func (l *BoltLimiter) Try(_ context.Context, id string, max int64, resetAfter int64, incrBy int64) (Result, error) {
+	algorithm, suffix, err := localAlgorithm(resetAfter)
+	if err != nil {
+		return Result{}, err
+	}
+	now := millis(time.Now())
+
+	var r Result
+	err = l.DB.Update(id+suffix, func(value []byte) ([]byte, time.Time, error) {
+		e := &memoryEntry{}
+		if value != nil {
+			var saved boltEntry
+			if err := json.Unmarshal(value, &saved); err != nil {
+				return nil, time.Time{}, err
+			}
+			e = saved.entry()
+		}
+		r = e.try(algorithm, max, resetAfter, incrBy, now)
+		value, err := json.Marshal(newBoltEntry(e))
+		return value, time.Unix(0, e.expires*int64(time.Millisecond)), err
+	})
+	if err != nil {
+		return Result{}, err
+	}
+	return r, nil
+}
+
+func newBoltEntry(e *memoryEntry) boltEntry {
+	saved := boltEntry{
+		Count:       e.count,
+		WindowEnd:   e.windowEnd,
+		WindowStart: e.windowStart,
+		Current:     e.current,
+		Previous:    e.previous,
+		Tokens:      e.tokens,
+		Updated:     e.updated,
+	}
+	for _, entry := range e.log {
+		saved.Log = append(saved.Log, [2]int64{entry.at, entry.n})
+	}
+	return saved
+}
+
+func (saved *boltEntry) entry() *memoryEntry {
+	e := &memoryEntry{
+		count:       saved.Count,
+		windowEnd:   saved.WindowEnd,
+		windowStart: saved.WindowStart,
+		current:     saved.Current,
+		previous:    saved.Previous,
+		tokens:      saved.Tokens,
+		updated:     saved.Updated,
+	}
+	for _, entry := range saved.Log {
+		e.log = append(e.log, memoryLogEntry{at: entry[0], n: entry[1]})
+	}
+	return e
+}
@@ -0,0 +1,41 @@
+package security
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"tytanium/api"
+	"tytanium/global"
+	"tytanium/store"
+)
+
+func TestBoltLimiterKeepsCountersAcrossRestarts(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tytanium.db")
+	for _, algorithm := range []string{AlgorithmFixedWindow, AlgorithmSlidingWindowLog, AlgorithmSlidingWindowCounter, AlgorithmTokenBucket} {
+		t.Run(algorithm, func(t *testing.T) {
+			c := &api.Configuration{}
+			c.RateLimit.Algorithm = algorithm
+			global.SetConfig(c)
+
+			try := func(wantAllowed bool) {
+				t.Helper()
+				db, err := store.OpenBolt(path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer db.Close()
+				r, err := (&BoltLimiter{DB: db}).Try(context.Background(), "1.2.3.4", 2, 60000, 1)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if r.Allowed != wantAllowed {
+					t.Errorf("Allowed = %v, want %v", r.Allowed, wantAllowed)
+				}
+			}
+			// the database is opened again for every request
+			try(true)
+			try(true)
+			try(false)
+		})
+	}
+}
@@ -0,0 +1,92 @@
+package security
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+	"tytanium/global"
+	"tytanium/logger"
+)
+
+const (
+	// BackendRedis keeps rate limit counters in Redis.
+	BackendRedis = "redis"
+	// BackendMemory keeps rate limit counters in the memory of the process, for a single instance without Redis.
+	BackendMemory = "memory"
+	// BackendBolt keeps rate limit counters in the database file of the bolt store, for a single instance without
+	// Redis that keeps its limits across restarts.
+	BackendBolt = "bolt"
+
+	// FallbackMemory counts in memory while the backend is unavailable, so limits stay in place per instance.
+	FallbackMemory = "memory"
+	// FallbackOpen allows every request while the backend is unavailable.
+	FallbackOpen = "fail_open"
+	// FallbackClosed fails every rate limited request while the backend is unavailable.
+	FallbackClosed = "fail_closed"
+)
+
+// fallbackRetryInterval is how long the backend isn't used after it failed, so requests don't all wait for it to time out.
+const fallbackRetryInterval = 5 * time.Second
+
+// errLimiterUnavailable is returned while the backend isn't used in FallbackClosed mode.
+var errLimiterUnavailable = errors.New("the rate limit backend is unavailable")
+
+// FallbackLimiter uses Primary, and deals with it failing as set in RateLimit.Fallback.
+type FallbackLimiter struct {
+	Primary Limiter
+	Memory  *MemoryLimiter
+
+	mu       sync.Mutex
+	retryAt  time.Time
+	degraded bool
+}
+
+// Try implements Limiter.
+func (l *FallbackLimiter) Try(ctx context.Context, id string, max int64, resetAfter int64, incrBy int64) (Result, error) {
+	l.mu.Lock()
+	usePrimary := !l.degraded || !time.Now().Before(l.retryAt)
+	l.mu.Unlock()
+
+	var err error
+	if usePrimary {
+		var r Result
+		r, err = l.Primary.Try(ctx, id, max, resetAfter, incrBy)
+		l.report(err)
+		if err == nil {
+			return r, nil
+		}
+	} else {
+		err = errLimiterUnavailable
+	}
+
+	switch global.Config().RateLimit.Fallback {
+	case FallbackMemory:
+		return l.Memory.Try(ctx, id, max, resetAfter, incrBy)
+	case FallbackOpen:
+		return Result{Allowed: true, Limit: max, Remaining: max, Reset: time.Duration(resetAfter) * time.Millisecond}, nil
+	default:
+		return Result{}, err
+	}
+}
+
+// report keeps track of whether the primary limiter works, logging when that changes.
+func (l *FallbackLimiter) report(err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err != nil {
+		if !l.degraded {
+			log.Printf("Rate limit backend failed, falling back to %s: %v", global.Config().RateLimit.Fallback, err)
+			logger.Error("Rate limit backend failed", logger.Fields{"error": err, "fallback": global.Config().RateLimit.Fallback})
+		}
+		l.degraded = true
+		l.retryAt = time.Now().Add(fallbackRetryInterval)
+		return
+	}
+	if l.degraded {
+		log.Println("Rate limit backend is available again")
+		logger.Info("Rate limit backend recovered", nil)
+		l.degraded = false
+	}
+}
@@ -0,0 +1,204 @@
+package security
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+	"tytanium/global"
+)
+
+// memorySweepInterval is how often expired entries are removed from a MemoryLimiter.
+const memorySweepInterval = time.Minute
+
+// MemoryLimiter keeps its counters in the memory of the process. It behaves like RedisLimiter, but every instance
+// of the server counts on its own, and the counters are lost on restart.
+type MemoryLimiter struct {
+	mu        sync.Mutex
+	entries   map[string]*memoryEntry
+	lastSweep int64
+}
+
+// memoryEntry holds the state of one ID. Each algorithm only uses its own fields. All times are in milliseconds.
+type memoryEntry struct {
+	expires int64
+
+	// fixed window
+	count     int64
+	windowEnd int64
+
+	// sliding window log
+	log []memoryLogEntry
+
+	// sliding window counter
+	windowStart int64
+	current     int64
+	previous    int64
+
+	// token bucket
+	tokens  float64
+	updated int64
+}
+
+type memoryLogEntry struct {
+	at int64
+	n  int64
+}
+
+// NewMemoryLimiter returns an empty MemoryLimiter.
+func NewMemoryLimiter() *MemoryLimiter {
+	return &MemoryLimiter{entries: make(map[string]*memoryEntry)}
+}
+
+// Try implements Limiter.
+func (l *MemoryLimiter) Try(_ context.Context, id string, max int64, resetAfter int64, incrBy int64) (Result, error) {
+	algorithm, suffix, err := localAlgorithm(resetAfter)
+	if err != nil {
+		return Result{}, err
+	}
+	now := millis(time.Now())
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if now-l.lastSweep >= int64(memorySweepInterval/time.Millisecond) {
+		for k, e := range l.entries {
+			if e.expires <= now {
+				delete(l.entries, k)
+			}
+		}
+		l.lastSweep = now
+	}
+
+	key := id + suffix
+	e, ok := l.entries[key]
+	if !ok {
+		e = &memoryEntry{}
+		l.entries[key] = e
+	}
+
+	return e.try(algorithm, max, resetAfter, incrBy, now), nil
+}
+
+// localAlgorithm returns RateLimit.Algorithm and its key suffix, for the limiters that run the algorithms in Go.
+func localAlgorithm(resetAfter int64) (string, string, error) {
+	algorithm := global.Config().RateLimit.Algorithm
+	suffix, ok := limiterKeySuffixes[algorithm]
+	if !ok {
+		return "", "", fmt.Errorf("unknown rate limit algorithm %q", algorithm)
+	}
+	if resetAfter <= 0 {
+		return "", "", fmt.Errorf("the rate limit window must be positive, got %d", resetAfter)
+	}
+	return algorithm, suffix, nil
+}
+
+// try runs algorithm on the entry.
+func (e *memoryEntry) try(algorithm string, max, resetAfter, incrBy, now int64) Result {
+	var allowed bool
+	var remaining, reset int64
+	switch algorithm {
+	case AlgorithmFixedWindow:
+		allowed, remaining, reset = e.fixedWindow(max, resetAfter, incrBy, now)
+	case AlgorithmSlidingWindowLog:
+		allowed, remaining, reset = e.slidingWindowLog(max, resetAfter, incrBy, now)
+	case AlgorithmSlidingWindowCounter:
+		allowed, remaining, reset = e.slidingWindowCounter(max, resetAfter, incrBy, now)
+	case AlgorithmTokenBucket:
+		allowed, remaining, reset = e.tokenBucket(max, resetAfter, incrBy, now)
+	}
+
+	return Result{
+		Allowed:   allowed,
+		Limit:     max,
+		Remaining: remaining,
+		Reset:     time.Duration(reset) * time.Millisecond,
+	}
+}
+
+// The algorithms below work like the Lua scripts used by RedisLimiter.
+
+func (e *memoryEntry) fixedWindow(max, window, incr, now int64) (bool, int64, int64) {
+	if e.windowEnd <= now {
+		e.count, e.windowEnd = 0, now+window
+	}
+	e.expires = e.windowEnd
+	ttl := e.windowEnd - now
+	if e.count >= max {
+		return false, 0, ttl
+	}
+	e.count += incr
+	return true, positive(max - e.count), ttl
+}
+
+func (e *memoryEntry) slidingWindowLog(max, window, incr, now int64) (bool, int64, int64) {
+	var used int64
+	kept := e.log[:0]
+	for _, entry := range e.log {
+		if entry.at > now-window {
+			kept = append(kept, entry)
+			used += entry.n
+		}
+	}
+	e.log = kept
+
+	reset := window
+	if len(e.log) > 0 {
+		reset = e.log[0].at + window - now
+	}
+	if used >= max {
+		return false, 0, reset
+	}
+	e.log = append(e.log, memoryLogEntry{at: now, n: incr})
+	e.expires = now + window
+	return true, positive(max - used - incr), reset
+}
+
+func (e *memoryEntry) slidingWindowCounter(max, window, incr, now int64) (bool, int64, int64) {
+	windowStart := now - now%window
+	if e.windowStart != windowStart {
+		if e.windowStart == windowStart-window {
+			e.previous = e.current
+		} else {
+			e.previous = 0
+		}
+		e.current, e.windowStart = 0, windowStart
+	}
+	e.expires = windowStart + 2*window
+
+	elapsed := now - windowStart
+	used := int64(math.Floor(float64(e.previous)*float64(window-elapsed)/float64(window))) + e.current
+	if used >= max {
+		return false, 0, window - elapsed
+	}
+	e.current += incr
+	return true, positive(max - used - incr), window - elapsed
+}
+
+func (e *memoryEntry) tokenBucket(max, window, incr, now int64) (bool, int64, int64) {
+	rate := float64(max) / float64(window)
+	if e.updated == 0 {
+		e.tokens, e.updated = float64(max), now
+	}
+	if now > e.updated {
+		e.tokens = math.Min(float64(max), e.tokens+float64(now-e.updated)*rate)
+	}
+	e.updated = now
+
+	if e.tokens < 1 {
+		e.expires = now + int64(math.Ceil((float64(max)-e.tokens)/rate))
+		return false, 0, int64(math.Ceil((1 - e.tokens) / rate))
+	}
+	e.tokens -= float64(incr)
+	untilFull := int64(math.Ceil((float64(max) - e.tokens) / rate))
+	e.expires = now + untilFull
+	return true, positive(int64(math.Floor(e.tokens))), untilFull
+}
+
+func positive(i int64) int64 {
+	if i < 0 {
+		return 0
+	}
+	return i
+}
@@ -0,0 +1,136 @@
+package security
+
+import "testing"
+
+// limiterStep is one request at now milliseconds, and the result the algorithm should give for it.
+type limiterStep struct {
+	now           int64
+	incr          int64
+	wantAllowed   bool
+	wantRemaining int64
+	wantReset     int64
+}
+
+type limiterAlgorithm func(e *memoryEntry, max, window, incr, now int64) (bool, int64, int64)
+
+func runLimiterSteps(t *testing.T, algorithm limiterAlgorithm, max, window int64, steps []limiterStep) {
+	t.Helper()
+	e := &memoryEntry{}
+	for i, s := range steps {
+		allowed, remaining, reset := algorithm(e, max, window, s.incr, s.now)
+		if allowed != s.wantAllowed || remaining != s.wantRemaining || reset != s.wantReset {
+			t.Errorf("step %d at %d: got allowed=%v remaining=%d reset=%d, want allowed=%v remaining=%d reset=%d",
+				i, s.now, allowed, remaining, reset, s.wantAllowed, s.wantRemaining, s.wantReset)
+		}
+	}
+}
+
+// base keeps the times away from 0, which is also the zero value of the window fields.
+const base = 1000000
+
+func TestFixedWindow(t *testing.T) {
+	tests := []struct {
+		name  string
+		steps []limiterStep
+	}{
+		{"over the limit until the window resets", []limiterStep{
+			{base, 1, true, 2, 1000},
+			{base + 100, 1, true, 1, 900},
+			{base + 200, 1, true, 0, 800},
+			{base + 300, 1, false, 0, 700},
+			{base + 999, 1, false, 0, 1},
+			{base + 1000, 1, true, 2, 1000},
+		}},
+		{"a large increment goes through once", []limiterStep{
+			{base, 5, true, 0, 1000},
+			{base + 1, 1, false, 0, 999},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			runLimiterSteps(t, (*memoryEntry).fixedWindow, 3, 1000, tt.steps)
+		})
+	}
+}
+
+func TestSlidingWindowLog(t *testing.T) {
+	tests := []struct {
+		name  string
+		steps []limiterStep
+	}{
+		{"old entries leave the window one by one", []limiterStep{
+			{base, 1, true, 2, 1000},
+			{base + 400, 1, true, 1, 600},
+			{base + 800, 1, true, 0, 200},
+			{base + 900, 1, false, 0, 100},
+			{base + 1000, 1, true, 0, 400},
+			{base + 1001, 1, false, 0, 399},
+			{base + 1400, 1, true, 0, 400},
+		}},
+		{"a large increment goes through once", []limiterStep{
+			{base, 5, true, 0, 1000},
+			{base + 999, 1, false, 0, 1},
+			{base + 1000, 1, true, 2, 1000},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			runLimiterSteps(t, (*memoryEntry).slidingWindowLog, 3, 1000, tt.steps)
+		})
+	}
+}
+
+func TestSlidingWindowCounter(t *testing.T) {
+	tests := []struct {
+		name  string
+		steps []limiterStep
+	}{
+		{"the previous window is weighted by how much of it overlaps", []limiterStep{
+			{base, 1, true, 3, 1000},
+			{base + 100, 1, true, 2, 900},
+			{base + 200, 1, true, 1, 800},
+			{base + 300, 1, true, 0, 700},
+			{base + 400, 1, false, 0, 600},
+			// half of the previous window's 4 still counts
+			{base + 1500, 1, true, 1, 500},
+			{base + 1600, 1, true, 1, 400},
+			{base + 1700, 1, true, 0, 300},
+			{base + 1750, 1, false, 0, 250},
+		}},
+		{"a window that isn't the previous one is forgotten", []limiterStep{
+			{base, 4, true, 0, 1000},
+			{base + 2500, 1, true, 3, 500},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			runLimiterSteps(t, (*memoryEntry).slidingWindowCounter, 4, 1000, tt.steps)
+		})
+	}
+}
+
+func TestTokenBucket(t *testing.T) {
+	// 2 tokens per 512 ms, so one comes back every 256 ms
+	tests := []struct {
+		name  string
+		steps []limiterStep
+	}{
+		{"tokens come back over time", []limiterStep{
+			{base, 1, true, 1, 256},
+			{base, 1, true, 0, 512},
+			{base + 128, 1, false, 0, 128},
+			{base + 256, 1, true, 0, 512},
+			{base + 2000, 1, true, 1, 256},
+		}},
+		{"a large increment goes through once and is paid back", []limiterStep{
+			{base, 5, true, 0, 1280},
+			{base + 256, 1, false, 0, 768},
+			{base + 1024, 1, true, 0, 512},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			runLimiterSteps(t, (*memoryEntry).tokenBucket, 2, 512, tt.steps)
+		})
+	}
+}
@@ -0,0 +1,133 @@
+package security
+
+import (
+	"context"
+	"fmt"
+	"github.com/go-redis/redis/v8"
+	"time"
+	"tytanium/global"
+	"tytanium/utils"
+)
+
+// Every script gets KEYS[1] = the ID, ARGV = max, window in ms, increment, current time in ms, unique string,
+// and returns {allowed (0/1), remaining, reset in ms}. Usage is allowed as long as it's below max before the
+// increment, so a single large increment (like a big download) can still go through once.
+// Each script only touches KEYS[1], so they work with Redis Cluster.
+var limiterScripts = map[string]*redis.Script{
+	AlgorithmFixedWindow: redis.NewScript(`
+local max, window, incr = tonumber(ARGV[1]), tonumber(ARGV[2]), tonumber(ARGV[3])
+local current = tonumber(redis.call('GET', KEYS[1]) or '0')
+local ttl = redis.call('PTTL', KEYS[1])
+if ttl <= 0 then
+	-- no window yet, or a key without an expiry left behind by an older version
+	redis.call('SET', KEYS[1], incr, 'PX', window)
+	return {1, math.max(max - incr, 0), window}
+end
+if current >= max then
+	return {0, 0, ttl}
+end
+current = redis.call('INCRBY', KEYS[1], incr)
+return {1, math.max(max - current, 0), ttl}
+`),
+	AlgorithmSlidingWindowLog: redis.NewScript(`
+local max, window, incr, now = tonumber(ARGV[1]), tonumber(ARGV[2]), tonumber(ARGV[3]), tonumber(ARGV[4])
+redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', now - window)
+local entries = redis.call('ZRANGE', KEYS[1], 0, -1, 'WITHSCORES')
+local used = 0
+for i = 1, #entries, 2 do
+	used = used + tonumber(string.match(entries[i], ':(%d+)$'))
+end
+local reset = window
+if #entries > 0 then
+	reset = tonumber(entries[2]) + window - now
+end
+if used >= max then
+	return {0, 0, reset}
+end
+redis.call('ZADD', KEYS[1], now, now .. ':' .. ARGV[5] .. ':' .. incr)
+redis.call('PEXPIRE', KEYS[1], window)
+return {1, math.max(max - used - incr, 0), reset}
+`),
+	AlgorithmSlidingWindowCounter: redis.NewScript(`
+local max, window, incr, now = tonumber(ARGV[1]), tonumber(ARGV[2]), tonumber(ARGV[3]), tonumber(ARGV[4])
+local windowStart = now - (now % window)
+local h = redis.call('HMGET', KEYS[1], 'w', 'c', 'p')
+local w, current, previous = tonumber(h[1]), tonumber(h[2]) or 0, tonumber(h[3]) or 0
+if w ~= windowStart then
+	if w == windowStart - window then
+		previous = current
+	else
+		previous = 0
+	end
+	current = 0
+end
+local elapsed = now - windowStart
+local used = math.floor(previous * (window - elapsed) / window) + current
+local allowed = 0
+if used < max then
+	allowed = 1
+	current = current + incr
+	used = used + incr
+end
+redis.call('HSET', KEYS[1], 'w', windowStart, 'c', current, 'p', previous)
+redis.call('PEXPIRE', KEYS[1], window * 2)
+return {allowed, math.max(max - used, 0), window - elapsed}
+`),
+	AlgorithmTokenBucket: redis.NewScript(`
+local max, window, incr, now = tonumber(ARGV[1]), tonumber(ARGV[2]), tonumber(ARGV[3]), tonumber(ARGV[4])
+local rate = max / window
+local h = redis.call('HMGET', KEYS[1], 't', 'ts')
+local tokens, ts = tonumber(h[1]), tonumber(h[2])
+if tokens == nil or ts == nil then
+	tokens, ts = max, now
+end
+tokens = math.min(max, tokens + math.max(now - ts, 0) * rate)
+if tokens < 1 then
+	redis.call('HSET', KEYS[1], 't', tostring(tokens), 'ts', now)
+	redis.call('PEXPIRE', KEYS[1], math.ceil((max - tokens) / rate))
+	return {0, 0, math.ceil((1 - tokens) / rate)}
+end
+tokens = tokens - incr
+local untilFull = math.ceil((max - tokens) / rate)
+redis.call('HSET', KEYS[1], 't', tostring(tokens), 'ts', now)
+redis.call('PEXPIRE', KEYS[1], untilFull)
+return {1, math.max(math.floor(tokens), 0), untilFull}
+`),
+}
+
+// RedisLimiter keeps its counters in Redis, so they're shared by every instance of the server.
+// The check and the increment happen atomically in a Lua script, so concurrent requests can't go over the limit together.
+type RedisLimiter struct {
+	Client redis.UniversalClient
+	// Prefix is put in front of every key.
+	Prefix string
+}
+
+// Try implements Limiter.
+func (l *RedisLimiter) Try(ctx context.Context, id string, max int64, resetAfter int64, incrBy int64) (Result, error) {
+	algorithm := global.Config().RateLimit.Algorithm
+	script, ok := limiterScripts[algorithm]
+	if !ok {
+		return Result{}, fmt.Errorf("unknown rate limit algorithm %q", algorithm)
+	}
+
+	nonce, err := utils.RandomHex(6)
+	if err != nil {
+		return Result{}, err
+	}
+
+	v, err := script.Run(ctx, l.Client, []string{l.Prefix + id + limiterKeySuffixes[algorithm]}, max, resetAfter, incrBy, millis(time.Now()), nonce).Int64Slice()
+	if err != nil {
+		return Result{}, err
+	}
+	if len(v) != 3 {
+		return Result{}, fmt.Errorf("rate limit script returned %d values instead of 3", len(v))
+	}
+
+	return Result{
+		Allowed:   v[0] == 1,
+		Limit:     max,
+		Remaining: v[1],
+		Reset:     time.Duration(v[2]) * time.Millisecond,
+	}, nil
+}
@@ -0,0 +1,73 @@
+package security
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"github.com/valyala/fasthttp"
+	"net"
+	"path"
+	"strings"
+	"tytanium/api"
+	"tytanium/global"
+	"tytanium/utils"
+)
+
+// authenticatedKeyPrefix is put in front of the hashed key that identifies clients using the master key.
+const authenticatedKeyPrefix = "key_"
+
+// Client is who a request is rate limited as.
+type Client struct {
+	// Key identifies the client in rate limit and bandwidth keys. It's a hash of the master key for authenticated
+	// clients, so they're limited together no matter where they connect from, and ClientKey otherwise.
+	Key string
+	// Authenticated is true if the request has the master key in its Authorization header.
+	Authenticated bool
+	// Exempt is true if the request isn't rate limited at all, as its key is in RateLimit.Exempt.Keys or its IP
+	// is in RateLimit.Exempt.CIDRs.
+	Exempt bool
+}
+
+// IdentifyClient returns who the request is rate limited as.
+func IdentifyClient(ctx *fasthttp.RequestCtx) Client {
+	c := global.Config()
+	authorization := ctx.Request.Header.Peek("authorization")
+
+	if len(authorization) > 0 {
+		for _, k := range c.RateLimit.Exempt.Keys {
+			if subtle.ConstantTimeCompare(authorization, []byte(k)) == 1 {
+				return Client{Exempt: true}
+			}
+		}
+	}
+	if len(c.RateLimitExemptNets) > 0 && utils.IPInNets(net.ParseIP(utils.GetIP(ctx)), c.RateLimitExemptNets) {
+		return Client{Exempt: true}
+	}
+
+	// without a master key everyone is authorized, which doesn't make anyone special
+	if len(c.Security.MasterKey) > 0 && subtle.ConstantTimeCompare(authorization, []byte(c.Security.MasterKey)) == 1 {
+		sum := sha256.Sum256(authorization)
+		return Client{Key: authenticatedKeyPrefix + hex.EncodeToString(sum[:8]), Authenticated: true}
+	}
+	return Client{Key: ClientKey(ctx)}
+}
+
+// MatchPolicy returns the first policy whose route matches p, ignoring case, or nil if none do.
+func MatchPolicy(policies []api.RateLimitPolicy, p string) *api.RateLimitPolicy {
+	p = strings.ToLower(p)
+	for i := range policies {
+		if ok, _ := path.Match(strings.ToLower(policies[i].Route), p); ok {
+			return &policies[i]
+		}
+	}
+	return nil
+}
+
+// PolicyLimit returns the limit of the policy that applies to client.
+// AuthenticatedLimit falls back to Limit if it's not set.
+func PolicyLimit(policy *api.RateLimitPolicy, client Client) int {
+	if client.Authenticated && policy.AuthenticatedLimit > 0 {
+		return policy.AuthenticatedLimit
+	}
+	return policy.Limit
+}
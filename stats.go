@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+	"tytanium/constants"
+	"tytanium/global"
+	"tytanium/logger"
+	"tytanium/store"
+)
+
+// countStoredFiles counts the files in dir and their total size, leaving out the temp files of unfinished uploads.
+func countStoredFiles(dir string) (int64, int64, error) {
+	var totalSize, fileCount int64
+	err := filepath.Walk(dir, func(p string, i os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !i.IsDir() && !strings.HasPrefix(i.Name(), constants.TempFilePrefix) {
+			totalSize += i.Size()
+			fileCount++
+		}
+		return nil
+	})
+	return totalSize, fileCount, err
+}
+
+// saveStats saves the result of countStoredFiles to s, for /stats to return.
+func saveStats(ctx context.Context, s store.Store, totalSize int64, fileCount int64, took time.Duration) error {
+	return s.Set(ctx, map[string]int64{
+		"sc_total_size":       totalSize,
+		"sc_file_count":       fileCount,
+		"sc_time_to_complete": took.Milliseconds(),
+		"sc_last_updated":     time.Now().UnixNano() / int64(time.Millisecond),
+	})
+}
+
+// collectStats counts the files in Storage.Directory and saves the result to the store every StatsCollectionInterval,
+// until stop is closed. It's used when Store.Type is bolt, as "tytanium stats -save" can't open the database file
+// while the server has it open.
+func collectStats(stop <-chan struct{}) {
+	for {
+		interval := time.Duration(global.Config().StatsCollectionInterval) * time.Millisecond
+		if interval > 0 {
+			start := time.Now()
+			totalSize, fileCount, err := countStoredFiles(global.Config().Storage.Directory)
+			if err == nil {
+				ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				err = saveStats(ctx, global.Store, totalSize, fileCount, time.Since(start))
+				cancel()
+			}
+			if err != nil {
+				logger.Error("Failed to collect stats", logger.Fields{"error": err})
+			}
+		} else {
+			// turned off, but it can be turned on again by a reload
+			interval = time.Minute
+		}
+
+		select {
+		case <-time.After(interval):
+		case <-stop:
+			return
+		}
+	}
+}
@@ -0,0 +1,245 @@
+package store
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"go.etcd.io/bbolt"
+	"sync"
+	"time"
+)
+
+// boltSweepInterval is how often expired hashes are deleted from the database.
+const boltSweepInterval = 10 * time.Minute
+
+var (
+	boltValues   = []byte("values")
+	boltHashes   = []byte("hashes")
+	boltExpiring = []byte("expiring")
+)
+
+// Bolt is a Store using a bbolt database file. Only one process can have the file open at a time.
+type Bolt struct {
+	db   *bbolt.DB
+	stop chan struct{}
+	once sync.Once
+}
+
+// boltHash is how a hash is saved in the database.
+type boltHash struct {
+	// Expires is when the hash expires, in milliseconds since the epoch.
+	Expires int64            `json:"e"`
+	Fields  map[string]int64 `json:"f"`
+}
+
+func (h *boltHash) expired(now time.Time) bool {
+	return h.Expires <= millis(now)
+}
+
+// millis returns t in milliseconds since the epoch.
+func millis(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+// OpenBolt opens the database file at path, creating it if it doesn't exist.
+func OpenBolt(path string) (*Bolt, error) {
+	db, err := bbolt.Open(path, 0600, &bbolt.Options{Timeout: time.Second})
+	if err == bbolt.ErrTimeout {
+		return nil, fmt.Errorf("%s is in use by another process (like a running server)", path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bbolt.Tx) error {
+		for _, name := range [][]byte{boltValues, boltHashes, boltExpiring} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+
+	b := &Bolt{db: db, stop: make(chan struct{})}
+	go b.sweep()
+	return b, nil
+}
+
+// Get implements Store.
+func (b *Bolt) Get(_ context.Context, key string) (int64, error) {
+	var v int64
+	err := b.db.View(func(tx *bbolt.Tx) error {
+		if raw := tx.Bucket(boltValues).Get([]byte(key)); len(raw) == 8 {
+			v = int64(binary.BigEndian.Uint64(raw))
+		}
+		return nil
+	})
+	return v, err
+}
+
+// Set implements Store.
+func (b *Bolt) Set(_ context.Context, values map[string]int64) error {
+	return b.db.Update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(boltValues)
+		for k, v := range values {
+			raw := make([]byte, 8)
+			binary.BigEndian.PutUint64(raw, uint64(v))
+			if err := bucket.Put([]byte(k), raw); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// IncrFields implements Store.
+func (b *Bolt) IncrFields(_ context.Context, key string, fields map[string]int64, ttl time.Duration) error {
+	now := time.Now()
+	return b.db.Update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(boltHashes)
+		h, err := readHash(bucket.Get([]byte(key)))
+		if err != nil {
+			return err
+		}
+		if h == nil || h.expired(now) {
+			h = &boltHash{Fields: make(map[string]int64, len(fields))}
+		}
+		for f, v := range fields {
+			h.Fields[f] += v
+		}
+		h.Expires = millis(now.Add(ttl))
+
+		raw, err := json.Marshal(h)
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(key), raw)
+	})
+}
+
+// GetFields implements Store.
+func (b *Bolt) GetFields(_ context.Context, keys []string) ([]map[string]int64, error) {
+	now := time.Now()
+	hashes := make([]map[string]int64, 0, len(keys))
+	err := b.db.View(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(boltHashes)
+		for _, k := range keys {
+			h, err := readHash(bucket.Get([]byte(k)))
+			if err != nil {
+				return err
+			}
+			if h == nil || h.expired(now) {
+				hashes = append(hashes, map[string]int64{})
+				continue
+			}
+			hashes = append(hashes, h.Fields)
+		}
+		return nil
+	})
+	return hashes, err
+}
+
+// Update calls fn with the value saved at key, or nil if there is none or it expired, and saves the value fn returns
+// to expire at expires, all in one transaction. Concurrent calls are written together, so fn may be called again if
+// the transaction has to be retried.
+func (b *Bolt) Update(key string, fn func(value []byte) ([]byte, time.Time, error)) error {
+	now := time.Now()
+	return b.db.Batch(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(boltExpiring)
+		var value []byte
+		if raw := bucket.Get([]byte(key)); len(raw) >= 8 && int64(binary.BigEndian.Uint64(raw)) > millis(now) {
+			value = raw[8:]
+		}
+		value, expires, err := fn(value)
+		if err != nil {
+			return err
+		}
+		raw := make([]byte, 8, 8+len(value))
+		binary.BigEndian.PutUint64(raw, uint64(millis(expires)))
+		return bucket.Put([]byte(key), append(raw, value...))
+	})
+}
+
+// Ping implements Store.
+func (b *Bolt) Ping(_ context.Context) error {
+	return b.db.View(func(tx *bbolt.Tx) error {
+		return nil
+	})
+}
+
+// Close implements Store.
+func (b *Bolt) Close() error {
+	b.once.Do(func() {
+		close(b.stop)
+	})
+	return b.db.Close()
+}
+
+// sweep deletes expired hashes and values every boltSweepInterval until the database is closed.
+func (b *Bolt) sweep() {
+	t := time.NewTicker(boltSweepInterval)
+	defer t.Stop()
+	for {
+		b.deleteExpired()
+		select {
+		case <-t.C:
+		case <-b.stop:
+			return
+		}
+	}
+}
+
+func (b *Bolt) deleteExpired() {
+	now := time.Now()
+	_ = b.db.Update(func(tx *bbolt.Tx) error {
+		// hashes that can't be read are of no use either
+		err := deleteWhere(tx.Bucket(boltHashes), func(v []byte) bool {
+			h, err := readHash(v)
+			return err != nil || h.expired(now)
+		})
+		if err != nil {
+			return err
+		}
+		return deleteWhere(tx.Bucket(boltExpiring), func(v []byte) bool {
+			return len(v) < 8 || int64(binary.BigEndian.Uint64(v)) <= millis(now)
+		})
+	})
+}
+
+// deleteWhere deletes the keys of bucket whose value matches.
+func deleteWhere(bucket *bbolt.Bucket, match func(v []byte) bool) error {
+	var matched [][]byte
+	err := bucket.ForEach(func(k, v []byte) error {
+		if match(v) {
+			matched = append(matched, append([]byte(nil), k...))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, k := range matched {
+		if err := bucket.Delete(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readHash(raw []byte) (*boltHash, error) {
+	if raw == nil {
+		return nil, nil
+	}
+	var h boltHash
+	if err := json.Unmarshal(raw, &h); err != nil {
+		return nil, err
+	}
+	if h.Fields == nil {
+		h.Fields = make(map[string]int64)
+	}
+	return &h, nil
+}
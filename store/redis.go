@@ -0,0 +1,85 @@
+package store
+
+import (
+	"context"
+	"github.com/go-redis/redis/v8"
+	"strconv"
+	"time"
+)
+
+// Redis is a Store using a Redis database. Hashes are Redis hashes.
+type Redis struct {
+	Client redis.UniversalClient
+	// Prefix is put in front of every key.
+	Prefix string
+}
+
+// Get implements Store.
+func (r *Redis) Get(ctx context.Context, key string) (int64, error) {
+	v, err := r.Client.Get(ctx, r.Prefix+key).Int64()
+	if err == redis.Nil {
+		return 0, nil
+	}
+	return v, err
+}
+
+// Set implements Store.
+func (r *Redis) Set(ctx context.Context, values map[string]int64) error {
+	_, err := r.Client.Pipelined(ctx, func(p redis.Pipeliner) error {
+		for k, v := range values {
+			p.Set(ctx, r.Prefix+k, v, 0)
+		}
+		return nil
+	})
+	return err
+}
+
+// IncrFields implements Store.
+func (r *Redis) IncrFields(ctx context.Context, key string, fields map[string]int64, ttl time.Duration) error {
+	_, err := r.Client.Pipelined(ctx, func(p redis.Pipeliner) error {
+		for f, v := range fields {
+			p.HIncrBy(ctx, r.Prefix+key, f, v)
+		}
+		p.Expire(ctx, r.Prefix+key, ttl)
+		return nil
+	})
+	return err
+}
+
+// GetFields implements Store.
+func (r *Redis) GetFields(ctx context.Context, keys []string) ([]map[string]int64, error) {
+	cmds := make([]*redis.StringStringMapCmd, 0, len(keys))
+	_, err := r.Client.Pipelined(ctx, func(p redis.Pipeliner) error {
+		for _, k := range keys {
+			cmds = append(cmds, p.HGetAll(ctx, r.Prefix+k))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	hashes := make([]map[string]int64, 0, len(cmds))
+	for _, cmd := range cmds {
+		h := make(map[string]int64, len(cmd.Val()))
+		for f, v := range cmd.Val() {
+			i, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				return nil, err
+			}
+			h[f] = i
+		}
+		hashes = append(hashes, h)
+	}
+	return hashes, nil
+}
+
+// Ping implements Store.
+func (r *Redis) Ping(ctx context.Context) error {
+	return r.Client.Ping(ctx).Err()
+}
+
+// Close implements Store.
+func (r *Redis) Close() error {
+	return r.Client.Close()
+}
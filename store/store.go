@@ -0,0 +1,31 @@
+// Package store keeps the values the server needs besides files, like stats and traffic counters,
+// either in Redis or in an embedded database file.
+package store
+
+import (
+	"context"
+	"time"
+)
+
+const (
+	// TypeRedis keeps everything in Redis.
+	TypeRedis = "redis"
+	// TypeBolt keeps everything in a bbolt database file, for a single instance without Redis.
+	TypeBolt = "bolt"
+)
+
+// Store keeps integer values and hashes of counters which expire.
+type Store interface {
+	// Get returns the value of key, or 0 if it isn't set.
+	Get(ctx context.Context, key string) (int64, error)
+	// Set sets each key to its value, without an expiry.
+	Set(ctx context.Context, values map[string]int64) error
+	// IncrFields adds to the fields of the hash at key, and makes the hash expire after ttl.
+	IncrFields(ctx context.Context, key string, fields map[string]int64, ttl time.Duration) error
+	// GetFields returns the fields of the hash at each key, in order. Hashes that don't exist are returned empty.
+	GetFields(ctx context.Context, keys []string) ([]map[string]int64, error)
+	// Ping checks that the store can be used.
+	Ping(ctx context.Context) error
+	// Close releases the store.
+	Close() error
+}
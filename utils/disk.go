@@ -0,0 +1,14 @@
+package utils
+
+import "errors"
+
+// ErrDiskSpaceUnsupported is returned by GetDiskSpace on platforms where the free space can't be read.
+var ErrDiskSpaceUnsupported = errors.New("reading the free disk space is not supported on this platform")
+
+// DiskSpace is the space of a filesystem, in bytes.
+type DiskSpace struct {
+	// Free is the space available to the server, which leaves out space reserved for root.
+	Free uint64
+	// Total is the size of the filesystem.
+	Total uint64
+}
@@ -0,0 +1,9 @@
+//go:build !linux && !darwin && !freebsd && !dragonfly && !windows
+// +build !linux,!darwin,!freebsd,!dragonfly,!windows
+
+package utils
+
+// GetDiskSpace returns ErrDiskSpaceUnsupported, as there's no implementation for this platform.
+func GetDiskSpace(path string) (DiskSpace, error) {
+	return DiskSpace{}, ErrDiskSpaceUnsupported
+}
@@ -0,0 +1,18 @@
+//go:build linux || darwin || freebsd || dragonfly
+// +build linux darwin freebsd dragonfly
+
+package utils
+
+import "syscall"
+
+// GetDiskSpace returns the space of the filesystem path is on.
+func GetDiskSpace(path string) (DiskSpace, error) {
+	var s syscall.Statfs_t
+	if err := syscall.Statfs(path, &s); err != nil {
+		return DiskSpace{}, err
+	}
+	return DiskSpace{
+		Free:  uint64(s.Bavail) * uint64(s.Bsize),
+		Total: uint64(s.Blocks) * uint64(s.Bsize),
+	}, nil
+}
@@ -0,0 +1,19 @@
+//go:build windows
+// +build windows
+
+package utils
+
+import "golang.org/x/sys/windows"
+
+// GetDiskSpace returns the space of the filesystem path is on.
+func GetDiskSpace(path string) (DiskSpace, error) {
+	p, err := windows.UTF16PtrFromString(path)
+	if err != nil {
+		return DiskSpace{}, err
+	}
+	var s DiskSpace
+	if err := windows.GetDiskFreeSpaceEx(p, &s.Free, &s.Total, nil); err != nil {
+		return DiskSpace{}, err
+	}
+	return s, nil
+}
@@ -1,18 +1,133 @@
 package utils
 
-import "github.com/valyala/fasthttp"
+import (
+	"github.com/valyala/fasthttp"
+	"net"
+	"strings"
+	"tytanium/global"
+)
 
 const (
-	// CloudflareForwardedIP is the client's original IP given by CloudFlare in the request header.
+	// cloudflareForwardedIP is the client's original IP given by CloudFlare in the request header.
 	cloudflareForwardedIP = "CF-Connecting-IP"
+	realIP                = "X-Real-IP"
+	forwardedFor          = "X-Forwarded-For"
+	forwarded             = "Forwarded"
 )
 
-// GetIP gets the forwarded IP from Cloudflare if it's available,
-// or gets the remote IP as given by fasthttp.RequestCtx as a fallback.
+// GetIP gets the client's IP. If the request came from a trusted proxy (Security.TrustedProxies), or through a
+// Unix socket with Security.TrustUnixSocket, the headers in Security.ClientIPHeaders are checked in order, and the
+// first one giving an IP wins. Otherwise, or if none of them do, the remote IP as given by fasthttp.RequestCtx is used.
 func GetIP(ctx *fasthttp.RequestCtx) string {
-	forwardedIP := ctx.Request.Header.Peek(cloudflareForwardedIP)
-	if len(forwardedIP) != 0 {
-		return string(forwardedIP)
+	remoteIP := ctx.RemoteIP()
+	c := global.Config()
+	if c == nil {
+		return remoteIP.String()
+	}
+	trusted := IPInNets(remoteIP, c.TrustedProxyNets)
+	if ctx.RemoteAddr().Network() == "unix" {
+		// the remote IP of a Unix socket is 0.0.0.0, which TrustedProxies shouldn't be able to match by accident
+		trusted = c.Security.TrustUnixSocket
+	}
+	if !trusted {
+		return remoteIP.String()
+	}
+
+	for _, h := range c.Security.ClientIPHeaders {
+		v := string(ctx.Request.Header.Peek(h))
+		if len(v) == 0 {
+			continue
+		}
+		var ip net.IP
+		switch {
+		case strings.EqualFold(h, forwardedFor):
+			ip = clientFromChain(strings.Split(v, ","), c.TrustedProxyNets)
+		case strings.EqualFold(h, forwarded):
+			ip = clientFromChain(forwardedForValues(v), c.TrustedProxyNets)
+		default:
+			// CF-Connecting-IP, X-Real-IP and the like hold a single IP
+			ip = parseIP(v)
+		}
+		if ip != nil {
+			return ip.String()
+		}
+	}
+	return remoteIP.String()
+}
+
+// clientFromChain returns the client IP from a list of IPs where each proxy appended the address it received the
+// request from, like X-Forwarded-For. The list is walked from the right, skipping trusted proxies,
+// so IPs the client made up itself on the left are never used.
+func clientFromChain(chain []string, trusted []*net.IPNet) net.IP {
+	var ip net.IP
+	for i := len(chain) - 1; i >= 0; i-- {
+		parsed := parseIP(chain[i])
+		if parsed == nil {
+			// the chain can't be trusted beyond a value that isn't an IP
+			break
+		}
+		ip = parsed
+		if !IPInNets(ip, trusted) {
+			break
+		}
+	}
+	return ip
+}
+
+// forwardedForValues returns the for= values of a Forwarded header (RFC 7239), in order.
+func forwardedForValues(header string) []string {
+	var values []string
+	for _, element := range strings.Split(header, ",") {
+		for _, pair := range strings.Split(element, ";") {
+			kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+			if len(kv) == 2 && strings.EqualFold(kv[0], "for") {
+				values = append(values, kv[1])
+			}
+		}
+	}
+	return values
+}
+
+// parseIP parses an IP which may be quoted, bracketed and/or have a port, as found in the headers above.
+func parseIP(s string) net.IP {
+	s = strings.Trim(strings.TrimSpace(s), `"`)
+	if host, _, err := net.SplitHostPort(s); err == nil {
+		s = host
+	}
+	return net.ParseIP(strings.Trim(s, "[]"))
+}
+
+// ParseCIDRs parses a list of CIDRs like 10.0.0.0/8. Single IPs are accepted as well.
+func ParseCIDRs(list []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(list))
+	for _, s := range list {
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, &net.ParseError{Type: "IP address", Text: s}
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// IPInNets reports whether ip is in any of the given networks.
+func IPInNets(ip net.IP, nets []*net.IPNet) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
 	}
-	return ctx.RemoteIP().String()
+	return false
 }
@@ -0,0 +1,127 @@
+package utils
+
+import (
+	"github.com/valyala/fasthttp"
+	"net"
+	"reflect"
+	"testing"
+	"tytanium/api"
+	"tytanium/global"
+)
+
+func mustParseCIDRs(t *testing.T, list ...string) []*net.IPNet {
+	t.Helper()
+	nets, err := ParseCIDRs(list)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return nets
+}
+
+func TestClientFromChain(t *testing.T) {
+	trusted := mustParseCIDRs(t, "10.0.0.0/8", "2001:db8::/32")
+	tests := []struct {
+		name  string
+		chain []string
+		want  string
+	}{
+		{"single client", []string{"203.0.113.7"}, "203.0.113.7"},
+		{"spoofed entries on the left are skipped", []string{"1.2.3.4", "203.0.113.7"}, "203.0.113.7"},
+		{"trusted proxies on the right are skipped", []string{"1.2.3.4", "203.0.113.7", "10.0.0.2", "10.0.0.1"}, "203.0.113.7"},
+		{"whitespace and ports", []string{" 1.2.3.4", " 203.0.113.7:4711 ", " 10.0.0.1"}, "203.0.113.7"},
+		{"ipv6", []string{"[2001:db8::1]:443", "2001:db9::5"}, "2001:db9::5"},
+		{"ipv6 behind trusted ipv6 proxy", []string{"2001:db9::5", "2001:db8::1"}, "2001:db9::5"},
+		{"only trusted proxies gives the leftmost", []string{"10.0.0.3", "10.0.0.2"}, "10.0.0.3"},
+		{"garbage stops the walk", []string{"203.0.113.7", "unknown", "10.0.0.1"}, "10.0.0.1"},
+		{"garbage at the end", []string{"203.0.113.7", "not an ip"}, ""},
+		{"empty", nil, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := clientFromChain(tt.chain, trusted)
+			if (got == nil && len(tt.want) > 0) || (got != nil && got.String() != tt.want) {
+				t.Errorf("clientFromChain(%q) = %v, want %q", tt.chain, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestForwardedForValues(t *testing.T) {
+	tests := []struct {
+		header string
+		want   []string
+	}{
+		{"for=192.0.2.60", []string{"192.0.2.60"}},
+		{"for=192.0.2.60;proto=http;by=203.0.113.43", []string{"192.0.2.60"}},
+		{"for=192.0.2.43, for=198.51.100.17", []string{"192.0.2.43", "198.51.100.17"}},
+		{`For="[2001:db8:cafe::17]:4711"`, []string{`"[2001:db8:cafe::17]:4711"`}},
+		{"proto=https;host=example.com", nil},
+		{"", nil},
+	}
+	for _, tt := range tests {
+		if got := forwardedForValues(tt.header); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("forwardedForValues(%q) = %q, want %q", tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestClientFromForwarded(t *testing.T) {
+	trusted := mustParseCIDRs(t, "10.0.0.1")
+	tests := []struct {
+		header string
+		want   string
+	}{
+		{`for="[2001:db8:cafe::17]:4711"`, "2001:db8:cafe::17"},
+		{"for=1.2.3.4, for=203.0.113.7;proto=https, for=10.0.0.1", "203.0.113.7"},
+		{"for=_hidden, for=203.0.113.7", "203.0.113.7"},
+		{"for=203.0.113.7, for=_hidden", ""},
+	}
+	for _, tt := range tests {
+		got := clientFromChain(forwardedForValues(tt.header), trusted)
+		if (got == nil && len(tt.want) > 0) || (got != nil && got.String() != tt.want) {
+			t.Errorf("client from Forwarded %q = %v, want %q", tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestGetIP(t *testing.T) {
+	tcpProxy := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1234}
+	tcpClient := &net.TCPAddr{IP: net.ParseIP("198.51.100.9"), Port: 1234}
+	unix := &net.UnixAddr{Name: "@", Net: "unix"}
+
+	tests := []struct {
+		name            string
+		remote          net.Addr
+		headers         map[string]string
+		clientIPHeaders []string
+		trustUnix       bool
+		want            string
+	}{
+		{"headers are ignored from untrusted peers", tcpClient, map[string]string{"X-Forwarded-For": "1.2.3.4"}, []string{"X-Forwarded-For"}, false, "198.51.100.9"},
+		{"header from a trusted proxy", tcpProxy, map[string]string{"X-Forwarded-For": "1.2.3.4, 203.0.113.7"}, []string{"X-Forwarded-For"}, false, "203.0.113.7"},
+		{"headers that aren't listed are ignored", tcpProxy, map[string]string{"CF-Connecting-IP": "1.2.3.4", "X-Forwarded-For": "203.0.113.7"}, []string{"X-Forwarded-For"}, false, "203.0.113.7"},
+		{"no headers are trusted by default", tcpProxy, map[string]string{"CF-Connecting-IP": "1.2.3.4"}, nil, false, "10.0.0.1"},
+		{"headers are checked in order", tcpProxy, map[string]string{"X-Real-IP": "203.0.113.8", "X-Forwarded-For": "203.0.113.7"}, []string{"X-Real-IP", "X-Forwarded-For"}, false, "203.0.113.8"},
+		{"invalid header falls through", tcpProxy, map[string]string{"X-Real-IP": "nope"}, []string{"X-Real-IP"}, false, "10.0.0.1"},
+		{"unix socket isn't trusted by default", unix, map[string]string{"X-Forwarded-For": "1.2.3.4"}, []string{"X-Forwarded-For"}, false, "0.0.0.0"},
+		{"unix socket with TrustUnixSocket", unix, map[string]string{"X-Forwarded-For": "1.2.3.4"}, []string{"X-Forwarded-For"}, true, "1.2.3.4"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &api.Configuration{TrustedProxyNets: mustParseCIDRs(t, "10.0.0.1")}
+			c.Security.ClientIPHeaders = tt.clientIPHeaders
+			c.Security.TrustUnixSocket = tt.trustUnix
+			global.SetConfig(c)
+
+			var req fasthttp.Request
+			for k, v := range tt.headers {
+				req.Header.Set(k, v)
+			}
+			var ctx fasthttp.RequestCtx
+			ctx.Init(&req, tt.remote, nil)
+			if got := GetIP(&ctx); got != tt.want {
+				t.Errorf("GetIP() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
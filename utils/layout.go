@@ -0,0 +1,73 @@
+package utils
+
+import (
+	"path"
+	"path/filepath"
+	"tytanium/global"
+)
+
+const (
+	// LayoutFlat stores every file directly in Storage.Directory.
+	LayoutFlat = "flat"
+	// LayoutSharded stores files in subdirectories of Storage.Directory named after the first
+	// Storage.ShardLength characters of their ID, like files/ab/abXYZ.
+	LayoutSharded = "sharded"
+)
+
+// LayoutDir returns the directory the file (or ID) name is stored in within dir with the given layout.
+// Names that can't be sharded, because their ID is too short or isn't alphanumeric, are stored in dir.
+func LayoutDir(dir string, layout string, shardLength int, name string) string {
+	if layout != LayoutSharded {
+		return dir
+	}
+	shard, ok := shardOf(name, shardLength)
+	if !ok {
+		return dir
+	}
+	return filepath.Join(dir, shard)
+}
+
+// IsShard reports whether a subdirectory of Storage.Directory with the given name can hold files of the sharded layout.
+func IsShard(name string, shardLength int) bool {
+	return len(name) == shardLength && isAlphanumeric(name)
+}
+
+// FileDir returns the directory the file (or ID) name is stored in with Storage.Layout.
+func FileDir(name string) string {
+	c := global.Config()
+	return LayoutDir(c.Storage.Directory, c.Storage.Layout, c.Storage.ShardLength, name)
+}
+
+// FileDirs returns the directories the file (or ID) name can be stored in, so files are found while they're being
+// migrated: first the one of the other layout, then the one of Storage.Layout. "tytanium migrate" links a file
+// into its new directory before removing the old one, so checking them in this order never misses a file it moves.
+func FileDirs(name string) []string {
+	c := global.Config()
+	other := LayoutSharded
+	if c.Storage.Layout == LayoutSharded {
+		other = LayoutFlat
+	}
+	dir := FileDir(name)
+	otherDir := LayoutDir(c.Storage.Directory, other, c.Storage.ShardLength, name)
+	if dir == otherDir {
+		return []string{dir}
+	}
+	return []string{otherDir, dir}
+}
+
+func shardOf(name string, shardLength int) (string, bool) {
+	id := name[:len(name)-len(path.Ext(name))]
+	if shardLength < 1 || len(id) <= shardLength || !isAlphanumeric(id[:shardLength]) {
+		return "", false
+	}
+	return id[:shardLength], true
+}
+
+func isAlphanumeric(s string) bool {
+	for _, r := range s {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9') {
+			return false
+		}
+	}
+	return true
+}
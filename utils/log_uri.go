@@ -0,0 +1,59 @@
+package utils
+
+import (
+	"github.com/valyala/fasthttp"
+	"net"
+	"net/url"
+	"strings"
+)
+
+const encryptionKeyParam = "enc_key"
+
+// URIForLog returns the request URI as it should be written to logs.
+// Zero-width paths are decoded first so that the encryption key hidden in them can be found,
+// and if stripKey is true, the enc_key query parameter is removed.
+func URIForLog(requestURI []byte, stripKey bool) string {
+	uri := string(requestURI)
+	// same check as routes.ServeFile: a zero-width path always starts with a URL-encoded character
+	if len(uri) > 1 && uri[1] == '%' {
+		if decoded, err := url.QueryUnescape(uri); err == nil && len(decoded) > 1 {
+			uri = "/" + ZeroWidthToString(decoded[1:])
+		}
+	}
+	if !stripKey || !strings.Contains(uri, encryptionKeyParam) {
+		return uri
+	}
+
+	u := fasthttp.AcquireURI()
+	defer fasthttp.ReleaseURI(u)
+	if err := u.Parse(nil, []byte(uri)); err != nil {
+		// drop the whole query string rather than risk logging the key
+		return strings.SplitN(uri, "?", 2)[0]
+	}
+	u.QueryArgs().Del(encryptionKeyParam)
+	// RequestURI falls back to the original query string if no args are left, so set it explicitly
+	u.SetQueryString(u.QueryArgs().String())
+	return string(u.RequestURI())
+}
+
+// PathForLog returns only the path of URIForLog, with the encryption key always removed.
+func PathForLog(requestURI []byte) string {
+	uri := URIForLog(requestURI, true)
+	if i := strings.IndexByte(uri, '?'); i >= 0 {
+		return uri[:i]
+	}
+	return uri
+}
+
+// AnonymizeIP zeroes the last octet of an IPv4 address, or the last 80 bits of an IPv6 address.
+// If the IP can't be parsed, it is returned as is.
+func AnonymizeIP(ip string) string {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return ip
+	}
+	if v4 := parsed.To4(); v4 != nil {
+		return v4.Mask(net.CIDRMask(24, 32)).String()
+	}
+	return parsed.Mask(net.CIDRMask(48, 128)).String()
+}
@@ -1,6 +1,7 @@
 package utils
 
 import (
+	crand "crypto/rand"
 	"encoding/hex"
 	"math/rand"
 	"sync"
@@ -38,9 +39,10 @@ func RandBytes(n int, c chan<- string, onExit func()) {
 	c <- *(*string)(unsafe.Pointer(&b))
 }
 
+// RandomHex returns n cryptographically secure random bytes, hex encoded.
 func RandomHex(n int) (string, error) {
 	bytes := make([]byte, n)
-	if _, err := rand.Read(bytes); err != nil {
+	if _, err := crand.Read(bytes); err != nil {
 		return "", err
 	}
 	return hex.EncodeToString(bytes), nil
@@ -49,8 +51,8 @@ func RandomHex(n int) (string, error) {
 func RandString(len int) string {
 	var wg sync.WaitGroup
 	randomStringChan := make(chan string, 1)
+	wg.Add(1)
 	go func() {
-		wg.Add(1)
 		RandBytes(len, randomStringChan, func() { wg.Done() })
 	}()
 	wg.Wait()
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"fmt"
+	"github.com/gabriel-vasile/mimetype"
+	"github.com/go-redis/redis/v8"
+	"log"
+	"net"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"tytanium/api"
+	"tytanium/listener"
+	"tytanium/logger"
+	"tytanium/middleware"
+	"tytanium/security"
+	"tytanium/store"
+	"tytanium/utils"
+)
+
+// configurationErrors holds every problem validateConfiguration found.
+type configurationErrors []string
+
+func (e configurationErrors) Error() string {
+	return fmt.Sprintf("The configuration has %d problem(s):\n  - %s", len(e), strings.Join(e, "\n  - "))
+}
+
+// validateConfiguration checks that the configuration is usable. All problems are reported at once
+// as a configurationErrors, instead of stopping at the first one. Mime types in the filter lists that can't be
+// detected are removed from c with a warning.
+func validateConfiguration(c *api.Configuration) error {
+	var errs configurationErrors
+	addError := func(format string, a ...interface{}) {
+		errs = append(errs, fmt.Sprintf(format, a...))
+	}
+
+	if len(c.Domain) == 0 {
+		addError("Domain must be set in the configuration.")
+	} else if u, err := url.Parse(c.Domain); err != nil {
+		addError("Domain %q is not a valid URL, %v", c.Domain, err)
+	} else if u.Scheme != "http" && u.Scheme != "https" {
+		addError("Domain %q must start with http:// or https://", c.Domain)
+	} else if len(u.Host) == 0 {
+		addError("Domain %q has no host", c.Domain)
+	} else if strings.HasSuffix(c.Domain, "/") {
+		addError("Domain %q must not end with a slash", c.Domain)
+	}
+
+	if len(c.Encryption.Nonce) == 0 {
+		addError("You must set a nonce for encryption purposes. (Under Encryption.Nonce, use any string you want. It does not need to be secret.)")
+	}
+	if c.Encryption.EncryptionKeyLength < 1 {
+		addError("Encryption.EncryptionKeyLength must be at least 1, got %d", c.Encryption.EncryptionKeyLength)
+	}
+
+	if len(c.Storage.Directory) == 0 {
+		addError("Storage.Directory must not be empty")
+	}
+	if c.Storage.MaxSize < 1 {
+		addError("Storage.MaxSize must be at least 1 byte, got %d", c.Storage.MaxSize)
+	}
+	if c.Storage.IDLength < 1 {
+		addError("Storage.IDLength must be at least 1, got %d", c.Storage.IDLength)
+	}
+	if c.Storage.CollisionCheckAttempts < 1 {
+		addError("Storage.CollisionCheckAttempts must be at least 1, got %d (every upload would fail after a single collision)", c.Storage.CollisionCheckAttempts)
+	}
+	if c.Storage.MinFreeSpace < 0 {
+		addError("Storage.MinFreeSpace must not be negative, got %d", c.Storage.MinFreeSpace)
+	}
+	if c.Storage.MinFreePercent < 0 || c.Storage.MinFreePercent >= 100 {
+		addError("Storage.MinFreePercent must be at least 0 and less than 100, got %g", c.Storage.MinFreePercent)
+	}
+	if c.Storage.MaxTotalSize < 0 {
+		addError("Storage.MaxTotalSize must not be negative, got %d", c.Storage.MaxTotalSize)
+	} else if c.Storage.MaxTotalSize > 0 && c.Storage.MaxTotalSize < c.Storage.MaxSize {
+		addError("Storage.MaxTotalSize (%d) must be at least Storage.MaxSize (%d), or 0 for no cap", c.Storage.MaxTotalSize, c.Storage.MaxSize)
+	}
+	if c.Storage.EvictOldest && c.Storage.MaxTotalSize == 0 {
+		addError("Storage.EvictOldest needs Storage.MaxTotalSize to be set")
+	}
+	if c.Storage.Layout != utils.LayoutFlat && c.Storage.Layout != utils.LayoutSharded {
+		addError("Storage.Layout must be %s or %s, got %q", utils.LayoutFlat, utils.LayoutSharded, c.Storage.Layout)
+	}
+	if c.Storage.Layout == utils.LayoutSharded && (c.Storage.ShardLength < 1 || c.Storage.ShardLength >= c.Storage.IDLength) {
+		addError("Storage.ShardLength must be at least 1 and less than Storage.IDLength (%d), got %d", c.Storage.IDLength, c.Storage.ShardLength)
+	}
+
+	checkNotNegative := func(name string, v int) {
+		if v < 0 {
+			addError("%s must not be negative, got %d", name, v)
+		}
+	}
+	checkNotNegative("RateLimit.ResetAfter", c.RateLimit.ResetAfter)
+	if !security.IsAlgorithm(c.RateLimit.Algorithm) {
+		addError("RateLimit.Algorithm must be one of %s, %s, %s or %s, got %q", security.AlgorithmFixedWindow,
+			security.AlgorithmSlidingWindowLog, security.AlgorithmSlidingWindowCounter, security.AlgorithmTokenBucket, c.RateLimit.Algorithm)
+	}
+	if c.RateLimit.Backend != security.BackendRedis && c.RateLimit.Backend != security.BackendMemory && c.RateLimit.Backend != security.BackendBolt {
+		addError("RateLimit.Backend must be one of %s, %s or %s, got %q", security.BackendRedis, security.BackendMemory, security.BackendBolt, c.RateLimit.Backend)
+	}
+	if c.RateLimit.Backend == security.BackendBolt && c.Store.Type != store.TypeBolt {
+		addError("RateLimit.Backend can only be %s if Store.Type is %s as well", security.BackendBolt, store.TypeBolt)
+	}
+	if c.RateLimit.Fallback != security.FallbackMemory && c.RateLimit.Fallback != security.FallbackOpen && c.RateLimit.Fallback != security.FallbackClosed {
+		addError("RateLimit.Fallback must be one of %s, %s or %s, got %q", security.FallbackMemory, security.FallbackOpen, security.FallbackClosed, c.RateLimit.Fallback)
+	}
+	if c.RateLimit.IPv4Prefix < 1 || c.RateLimit.IPv4Prefix > 32 {
+		addError("RateLimit.IPv4Prefix must be between 1 and 32, got %d", c.RateLimit.IPv4Prefix)
+	}
+	if c.RateLimit.IPv6Prefix < 1 || c.RateLimit.IPv6Prefix > 128 {
+		addError("RateLimit.IPv6Prefix must be between 1 and 128, got %d", c.RateLimit.IPv6Prefix)
+	}
+	checkNotNegative("RateLimit.Path.Upload", c.RateLimit.Path.Upload)
+	checkNotNegative("RateLimit.Path.Global", c.RateLimit.Path.Global)
+	checkNotNegative("RateLimit.Path.GlobalAuthenticated", c.RateLimit.Path.GlobalAuthenticated)
+	for i, p := range c.RateLimit.Policies {
+		name := fmt.Sprintf("RateLimit.Policies[%d]", i)
+		if _, err := path.Match(p.Route, ""); err != nil || !strings.HasPrefix(p.Route, "/") {
+			addError("%s.Route must be a pattern starting with /, like /upload or /*.png, got %q", name, p.Route)
+		}
+		checkNotNegative(name+".Limit", p.Limit)
+		checkNotNegative(name+".AuthenticatedLimit", p.AuthenticatedLimit)
+		checkNotNegative(name+".ResetAfter", p.ResetAfter)
+	}
+	for i, k := range c.RateLimit.Exempt.Keys {
+		if len(k) == 0 {
+			addError("RateLimit.Exempt.Keys[%d] is empty", i)
+		}
+	}
+	if _, err := utils.ParseCIDRs(c.RateLimit.Exempt.CIDRs); err != nil {
+		addError("Invalid RateLimit.Exempt.CIDRs, %v", err)
+	}
+	checkNotNegative("RateLimit.Bandwidth.ResetAfter", c.RateLimit.Bandwidth.ResetAfter)
+	checkNotNegative("RateLimit.Bandwidth.Download", c.RateLimit.Bandwidth.Download)
+	checkNotNegative("RateLimit.Bandwidth.Upload", c.RateLimit.Bandwidth.Upload)
+	checkNotNegative("Server.ReadTimeout", c.Server.ReadTimeout)
+	checkNotNegative("Server.WriteTimeout", c.Server.WriteTimeout)
+	checkNotNegative("Server.ShutdownTimeout", c.Server.ShutdownTimeout)
+	checkNotNegative("StatsCollectionInterval", c.StatsCollectionInterval)
+	checkNotNegative("Logging.Rotation.MaxSize", c.Logging.Rotation.MaxSize)
+	checkNotNegative("Logging.Rotation.MaxAge", c.Logging.Rotation.MaxAge)
+	checkNotNegative("Logging.Rotation.MaxBackups", c.Logging.Rotation.MaxBackups)
+
+	if c.Server.Port < 1 || c.Server.Port > 65535 {
+		addError("Server.Port must be between 1 and 65535, got %d", c.Server.Port)
+	}
+	if c.Server.Concurrency < 1 {
+		addError("Server.Concurrency must be at least 1, got %d", c.Server.Concurrency)
+	}
+
+	for _, a := range c.Server.Listen {
+		if _, port, err := net.SplitHostPort(a); err != nil {
+			addError("Server.Listen address %q must be in the form host:port, %v", a, err)
+		} else if p, err := strconv.Atoi(port); err != nil || p < 0 || p > 65535 {
+			addError("Server.Listen address %q has an invalid port", a)
+		}
+	}
+	if len(c.Server.UnixSocket.Path) > 0 {
+		// an unquoted 0660 reaches here as "432", which would otherwise parse as a different mode
+		if _, err := strconv.ParseUint(c.Server.UnixSocket.Permissions, 8, 32); err != nil || !strings.HasPrefix(c.Server.UnixSocket.Permissions, "0") {
+			addError("Server.UnixSocket.Permissions %q must be a quoted octal file mode like \"0660\"", c.Server.UnixSocket.Permissions)
+		}
+	}
+
+	if c.Server.TLS.Enabled {
+		if len(c.Server.TLS.CertFile) == 0 || len(c.Server.TLS.KeyFile) == 0 {
+			addError("Server.TLS.CertFile and Server.TLS.KeyFile must be set when TLS is enabled")
+		}
+		if _, err := listener.TLSVersion(c.Server.TLS.MinVersion); err != nil {
+			addError("Invalid Server.TLS.MinVersion, %v", err)
+		}
+		if _, err := listener.CipherSuites(c.Server.TLS.CipherSuites); err != nil {
+			addError("Invalid Server.TLS.CipherSuites, %v", err)
+		}
+		checkNotNegative("Server.TLS.ReloadInterval", c.Server.TLS.ReloadInterval)
+		if c.Server.TLS.RedirectHTTPPort < 0 || c.Server.TLS.RedirectHTTPPort > 65535 {
+			addError("Server.TLS.RedirectHTTPPort must be between 0 (disabled) and 65535, got %d", c.Server.TLS.RedirectHTTPPort)
+		} else if c.Server.TLS.RedirectHTTPPort == c.Server.Port {
+			addError("Server.TLS.RedirectHTTPPort can't be the same as Server.Port")
+		}
+		if h := c.Server.TLS.RedirectHost; strings.ContainsAny(h, "/?#@ ") {
+			addError("Server.TLS.RedirectHost %q must be a host with an optional port, like example.com:8443", h)
+		}
+	}
+
+	checkRedisAddress := func(name string, a string) {
+		if _, port, err := net.SplitHostPort(a); err != nil {
+			addError("%s %q must be in the form host:port, %v", name, a, err)
+		} else if p, err := strconv.Atoi(port); err != nil || p < 1 || p > 65535 {
+			addError("%s %q must be in the form host:port, %q is not a valid port", name, a, port)
+		}
+	}
+	// the database of a URL like redis://localhost:6379/3 replaces Redis.DB
+	redisDB := c.Redis.DB
+	if len(c.Redis.URI) == 0 {
+		addError("Redis.URI must be set, for example localhost:6379 or redis://localhost:6379/0")
+	} else if isRedisURL(c.Redis.URI) {
+		if u, err := redis.ParseURL(c.Redis.URI); err != nil {
+			addError("Invalid Redis.URI, %v", err)
+		} else if u.DB != 0 {
+			redisDB = u.DB
+		}
+	} else {
+		checkRedisAddress("Redis.URI", c.Redis.URI)
+	}
+	for i, a := range c.Redis.Addresses {
+		checkRedisAddress(fmt.Sprintf("Redis.Addresses[%d]", i), a)
+	}
+	checkNotNegative("Redis.DB", c.Redis.DB)
+	if c.Redis.Cluster && len(c.Redis.MasterName) > 0 {
+		addError("Redis.Cluster and Redis.MasterName (Sentinel) can't be used together")
+	}
+	if c.Redis.Cluster && redisDB != 0 {
+		addError("Redis.DB (or the database in Redis.URI) must be 0 with Redis.Cluster, as a cluster only has database 0, got %d", redisDB)
+	}
+	if len(c.Redis.Addresses) > 1 && !c.Redis.Cluster && len(c.Redis.MasterName) == 0 {
+		addError("Redis.Addresses lists several servers, which needs Redis.Cluster or Redis.MasterName (Sentinel) to be set")
+	}
+	if len(c.Redis.MasterName) > 0 && len(c.Redis.Addresses) == 0 {
+		addError("Redis.Addresses must list the Sentinels when Redis.MasterName is set")
+	}
+	if (len(c.Redis.TLS.CertFile) == 0) != (len(c.Redis.TLS.KeyFile) == 0) {
+		addError("Redis.TLS.CertFile and Redis.TLS.KeyFile must be set together")
+	}
+	checkNotNegative("Redis.PoolSize", c.Redis.PoolSize)
+	checkNotNegative("Redis.MinIdleConns", c.Redis.MinIdleConns)
+	if c.Redis.MaxRetries < -1 {
+		addError("Redis.MaxRetries must be -1 (no retries) or more, got %d", c.Redis.MaxRetries)
+	}
+	checkNotNegative("Redis.DialTimeout", c.Redis.DialTimeout)
+	checkNotNegative("Redis.ReadTimeout", c.Redis.ReadTimeout)
+	checkNotNegative("Redis.WriteTimeout", c.Redis.WriteTimeout)
+	checkNotNegative("Redis.PoolTimeout", c.Redis.PoolTimeout)
+	switch c.Store.Type {
+	case store.TypeRedis:
+	case store.TypeBolt:
+		if len(c.Store.Path) == 0 {
+			addError("Store.Path must be set when Store.Type is %s", store.TypeBolt)
+		}
+	default:
+		addError("Store.Type must be %s or %s, got %q", store.TypeRedis, store.TypeBolt, c.Store.Type)
+	}
+
+	if _, err := utils.ParseCIDRs(c.Security.TrustedProxies); err != nil {
+		addError("Invalid Security.TrustedProxies, %v", err)
+	}
+	if (len(c.Security.TrustedProxies) > 0 || c.Security.TrustUnixSocket) && len(c.Security.ClientIPHeaders) == 0 {
+		log.Println("Warning: proxies are trusted, but Security.ClientIPHeaders is empty, so the client IP is never taken from a header")
+	}
+
+	// older example configurations list types that can't be detected, which never matched anything,
+	// so they're only warned about and left out
+	checkMimeTypes := func(name string, list []string) []string {
+		known := list[:0]
+		for _, m := range list {
+			if mimetype.Lookup(m) == nil {
+				log.Printf("Warning: %s contains %q, which is not a mime type that can be detected, ignoring it", name, m)
+				continue
+			}
+			known = append(known, m)
+		}
+		return known
+	}
+	c.Filter.Blacklist = checkMimeTypes("Filter.Blacklist", c.Filter.Blacklist)
+	c.Filter.Whitelist = checkMimeTypes("Filter.Whitelist", c.Filter.Whitelist)
+	c.Filter.Sanitize = checkMimeTypes("Filter.Sanitize", c.Filter.Sanitize)
+
+	if _, err := logger.ParseLevel(c.Logging.Level); err != nil {
+		addError("Invalid Logging.Level, %v", err)
+	}
+	if _, err := logger.ParseFormat(c.Logging.Format); err != nil {
+		addError("Invalid Logging.Format, %v", err)
+	}
+	switch c.Logging.AccessLog.Format {
+	case middleware.AccessLogFormatCommon, middleware.AccessLogFormatCombined, middleware.AccessLogFormatJSON:
+	default:
+		addError("Invalid Logging.AccessLog.Format %q, must be common, combined or json", c.Logging.AccessLog.Format)
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}